@@ -2,8 +2,16 @@ package gcloudcleanup
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
@@ -16,6 +24,7 @@ import (
 	"google.golang.org/api/option"
 	"gopkg.in/urfave/cli.v2"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/mihasya/go-metrics-librato"
 	"github.com/pkg/errors"
 	"github.com/rcrowley/go-metrics"
@@ -25,23 +34,81 @@ import (
 )
 
 var (
-	errInvalidInstancesMaxAge   = errors.New("invalid max age")
-	errInvalidArchiveSampleRate = errors.New("invalid archive sample rate")
-	errInvalidTraceSampleRate   = errors.New("invalid trace sample rate")
+	errInvalidInstancesMaxAge    = errors.New("invalid max age")
+	errInvalidDisksMaxAge        = errors.New("invalid disk max age")
+	errInvalidSnapshotsMaxAge    = errors.New("invalid snapshot max age")
+	errInvalidSnapshotsKeepLast  = errors.New("invalid snapshot keep last")
+	errInvalidArchiveSampleRate  = errors.New("invalid archive sample rate")
+	errInvalidTraceSampleRate    = errors.New("invalid trace sample rate")
+	errInvalidDeleteConcurrency  = errors.New("invalid delete concurrency")
+	errInvalidPlanFormat         = errors.New("invalid plan format")
+	errInvalidEntity             = errors.New("invalid entity")
+	errInvalidEntityBackoff      = errors.New("invalid entity backoff")
+	errInvalidEntitySchedule     = errors.New("invalid entity schedule")
+	errInvalidRateLimitAlgorithm = errors.New("invalid rate limit algorithm")
+	errInvalidRateLimitDuration  = errors.New("invalid rate limit duration")
+	errInvalidRateLimits         = errors.New("invalid rate limits")
+	errInvalidRateLimitRedis     = errors.New("invalid rate limit redis configuration")
+	errInvalidLeaderElection     = errors.New("invalid leader election configuration")
+	errInvalidRateLimitMinFactor = errors.New("invalid rate limit min factor")
+	errInvalidRateLimitRecovery  = errors.New("invalid rate limit recovery")
+)
+
+const (
+	rateLimitAlgorithmWatch         = "watch"
+	rateLimitAlgorithmFixedWindow   = "fixed-window"
+	rateLimitAlgorithmGCRA          = "gcra"
+	rateLimitAlgorithmSlidingWindow = "sliding-window"
 )
 
 type CLI struct {
-	projectID string
+	projectID  string
+	projectIDs []string
+
+	c             *cli.Context
+	ctx           context.Context
+	cs            *compute.Service
+	sc            *storage.Client
+	log           *logrus.Logger
+	rateLimiter   ratelimit.RateLimiter
+	rateLimits    rateLimits
+	redisPool     *redis.Pool
+	projectLister projectLister
+
+	rateLimitersMutex sync.Mutex
+	rateLimiters      map[string]ratelimit.RateLimiter
+
+	projectFilters           map[string]map[string][]string
+	projectRateLimitPrefixes map[string]string
+
+	policies *policyStore
+
+	// plan is set when running in plan mode
+	plan *plan
 
-	c           *cli.Context
-	ctx         context.Context
-	cs          *compute.Service
-	sc          *storage.Client
-	log         *logrus.Logger
-	rateLimiter ratelimit.RateLimiter
+	status *runStatus
 
-	instanceCleaner *instanceCleaner
-	imageCleaner    *imageCleaner
+	// leader is set when leader election is enabled
+	leader *leaderElection
+
+	projects map[string]*project
+
+	// projectList is the list of projects to clean up, resolved again by
+	// currentProjects every projectsRefresh
+	projectsMutex      sync.Mutex
+	projectList        []*project
+	projectsResolvedAt time.Time
+	projectsRefresh    time.Duration
+
+	backoff     *entityBackoff
+	maxFailures int
+
+	// runs counts the entity cleanup runs
+	runs int64
+
+	// entities is set by the list command, taking precedence over the
+	// entities flag
+	entities []string
 }
 
 func NewCLI(c *cli.Context) *CLI {
@@ -53,26 +120,38 @@ func NewCLI(c *cli.Context) *CLI {
 		c:   c,
 		ctx: context.Background(),
 		log: log,
+
+		rateLimiters: map[string]ratelimit.RateLimiter{},
+		projects:     map[string]*project{},
 	}
 }
 
 func (c *CLI) Run() error {
 	var err error
 
-	projectId := c.c.String("project-id")
-	if projectId == "" && metadata.OnGCE() {
-		projectId, err = metadata.ProjectID()
-		if err != nil {
-			return errors.Wrap(err, "could not get project id from metadata api")
-		}
+	if c.c.Bool("plan") {
+		return c.Plan()
 	}
-	if projectId == "" {
-		return errors.New("please provide a project-id")
+
+	startTime := time.Now()
+
+	err = c.parseProjects()
+	if err != nil {
+		return err
 	}
-	c.projectID = projectId
+
+	c.status = newRunStatus(c.c.Duration("health-stall-timeout"), startTime)
 
 	c.setupLogger()
-	c.setupRateLimiter()
+	err = c.setupRateLimiter()
+	if err != nil {
+		return err
+	}
+	err = c.setupLeaderElection()
+	if err != nil {
+		return err
+	}
+	c.setupSignals()
 
 	fields := logrus.Fields{}
 
@@ -83,6 +162,17 @@ func (c *CLI) Run() error {
 	c.log.WithFields(fields).Debug("configuration")
 
 	c.setupMetrics()
+	c.setupStatusServer()
+
+	err = c.setupPolicies(c.c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	err = c.setupProjects()
+	if err != nil {
+		return err
+	}
 
 	err = c.setupOpenCensus(c.c.String("account-json"))
 	if err != nil {
@@ -99,61 +189,422 @@ func (c *CLI) Run() error {
 		c.log.WithField("err", err).Fatal("failed to set up storage client")
 	}
 
+	c.status.setReady(true)
+
 	sleepDur := c.c.Duration("loop-sleep")
 	if sleepDur == (0 * time.Second) {
 		sleepDur = 5 * time.Minute
 		c.log.WithField("loop_sleep", sleepDur).Info("default loop sleep set")
 	}
+	c.projectsRefresh = sleepDur
 
 	once := c.c.Bool("once")
 
-	entities := c.c.StringSlice("entities")
-	if len(entities) == 0 {
-		entities = []string{"instances"}
-		c.log.WithField("entities", entities).Info("default entities set")
+	entities, entityMap, err := c.setupEntities()
+	if err != nil {
+		return err
 	}
 
-	entityMap := map[string]func() error{
-		"instances": c.cleanupInstances,
-		"images":    c.cleanupImages,
+	err = c.setupCleaners(entities)
+	if err != nil {
+		return err
+	}
+
+	schedules, err := parseEntitySchedules(c.c.StringSlice("entity-schedules"))
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to parse entity schedules")
+		return errInvalidEntitySchedule
+	}
+	for entity := range schedules {
+		if _, ok := entityMap[entity]; !ok {
+			c.log.WithField("type", entity).Error("schedule for unknown entity type")
+			return errInvalidEntitySchedule
+		}
 	}
 
-	for {
+	if c.c.Duration("entity-backoff") <= 0 || c.c.Duration("entity-max-backoff") < c.c.Duration("entity-backoff") {
+		c.log.WithFields(logrus.Fields{
+			"backoff":     c.c.Duration("entity-backoff"),
+			"max_backoff": c.c.Duration("entity-max-backoff"),
+		}).Error("entity backoff must be positive and not exceed max backoff")
+		return errInvalidEntityBackoff
+	}
+
+	c.backoff = newEntityBackoff(c.c.Duration("entity-backoff"), c.c.Duration("entity-max-backoff"))
+	c.maxFailures = c.c.Int("entity-max-failures")
+
+	if once {
 		for _, entity := range entities {
-			if f, ok := entityMap[entity]; ok {
-				c.log.WithField("type", entity).Debug("entering entity loop")
+			if c.ctx.Err() != nil {
+				break
+			}
+			c.runEntity(c.ctx, entity, entityMap[entity])
+		}
+	} else {
+		var wg sync.WaitGroup
 
-				err := f()
+		for _, entity := range entities {
+			entity, f := entity, entityMap[entity]
 
-				if err != nil {
-					c.log.WithFields(logrus.Fields{
-						"type": entity,
-						"err":  err,
-					}).Fatal("failure during entity cleanup")
-				}
-			} else {
-				c.log.WithField("type", entity).Fatal("unknown entity type")
+			s, ok := schedules[entity]
+			if !ok {
+				s = intervalSchedule{interval: sleepDur}
 			}
 
-			c.log.WithField("type", entity).Debug("done with entity loop")
+			es := &entityScheduler{
+				entity:   entity,
+				schedule: s,
+				jitter:   c.c.Duration("schedule-jitter"),
+				run: func(ctx context.Context) {
+					c.runEntity(ctx, entity, f)
+				},
+				log:    c.log.WithField("type", entity),
+				status: c.status,
+			}
+			es.start(c.ctx, &wg)
 		}
 
-		if once {
+		<-c.ctx.Done()
+		wg.Wait()
+	}
+
+	if c.leader != nil {
+		c.leader.release()
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"runs":        atomic.LoadInt64(&c.runs),
+		"uptime":      time.Since(startTime).Truncate(time.Second),
+		"interrupted": c.ctx.Err() != nil,
+	}).Info("exiting")
+
+	return nil
+}
+
+// runEntity cleans up an entity in every project, skipping projects it is
+// backing off in. With leader election, nothing is cleaned up unless this
+// replica is the leader.
+func (c *CLI) runEntity(ctx context.Context, entity string, f func(context.Context, *project) error) {
+	if c.leader != nil {
+		leaderCtx, stopLeading, leading := c.leader.lead(ctx)
+		defer stopLeading()
+		if !leading {
+			return
+		}
+		ctx = leaderCtx
+	}
+
+	atomic.AddInt64(&c.runs, 1)
+
+	for _, p := range c.currentProjects() {
+		if ctx.Err() != nil {
 			break
 		}
 
-		c.log.WithField("duration", sleepDur).Info("sleeping")
-		time.Sleep(sleepDur)
+		ready, retryAt := c.backoff.ready(entity, p.id, time.Now())
+		if !ready {
+			c.status.backingOff(entity, p.id, time.Now(), retryAt)
+			p.log.WithFields(logrus.Fields{
+				"type":     entity,
+				"retry_at": retryAt.Format(time.RFC3339),
+			}).Info("backing off entity cleanup")
+			continue
+		}
+
+		p.log.WithField("type", entity).Debug("entering entity loop")
+
+		c.status.started(entity, p.id, time.Now())
+
+		err := f(ctx, p)
+
+		if err != nil && ctx.Err() != nil {
+			c.status.finished(entity, p.id, time.Now(), outcomeInterrupted, err, p.counts(entity))
+			if c.ctx.Err() != nil {
+				p.log.WithField("type", entity).Info("entity cleanup interrupted by shutdown")
+			} else {
+				p.log.WithField("type", entity).Info("entity cleanup interrupted by losing leadership")
+			}
+			break
+		}
+
+		if err == nil {
+			c.status.finished(entity, p.id, time.Now(), outcomeSuccess, nil, p.counts(entity))
+			c.backoff.success(entity, p.id)
+			projectGauge(p.id, fmt.Sprintf("%s.consecutive_errors", entity), 0)
+			continue
+		}
+
+		c.status.finished(entity, p.id, time.Now(), outcomeFailure, err, p.counts(entity))
+
+		failures, retryAt := c.backoff.failure(entity, p.id, time.Now())
+		projectCounter(p.id, fmt.Sprintf("%s.errors", entity), 1)
+		projectGauge(p.id, fmt.Sprintf("%s.consecutive_errors", entity), int64(failures))
+
+		log := p.log.WithFields(logrus.Fields{
+			"type":     entity,
+			"err":      err,
+			"failures": failures,
+		})
+
+		if c.maxFailures > 0 && failures >= c.maxFailures {
+			log.Fatal("too many consecutive failures during entity cleanup")
+		}
+
+		log.WithField("retry_at", retryAt.Format(time.RFC3339)).Error("failure during entity cleanup")
+	}
+
+	c.log.WithField("type", entity).Debug("done with entity loop")
+}
+
+// currentProjects returns the projects to clean up, resolving them again if
+// they were last resolved more than a loop sleep ago.
+func (c *CLI) currentProjects() []*project {
+	c.projectsMutex.Lock()
+	defer c.projectsMutex.Unlock()
+
+	if time.Since(c.projectsResolvedAt) < c.projectsRefresh {
+		return c.projectList
 	}
+
+	projects, err := c.resolveProjects()
+	c.projectsResolvedAt = time.Now()
+	if err != nil {
+		c.log.WithField("err", err).Warn("failed to resolve projects, keeping previous list")
+		return c.projectList
+	}
+
+	c.projectList = projects
+	return projects
+}
+
+// setupSignals cancels the root context on SIGTERM or SIGINT. Cleanups in
+// flight get the shutdown grace period to finish.
+func (c *CLI) setupSignals() {
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.ctx = ctx
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigChan
+		c.log.WithFields(logrus.Fields{
+			"signal":       sig,
+			"grace_period": c.c.Duration("shutdown-grace-period"),
+		}).Info("received signal, shutting down")
+		c.status.setReady(false)
+		cancel()
+	}()
+}
+
+// setupStatusServer serves the health, readiness and status endpoints if a
+// status address is configured.
+func (c *CLI) setupStatusServer() {
+	addr := c.c.String("status-addr")
+	if addr == "" {
+		return
+	}
+
+	c.log.WithField("addr", addr).Info("starting status listener")
+
+	go func() {
+		err := http.ListenAndServe(addr, c.status.handler())
+		c.log.WithFields(logrus.Fields{
+			"addr": addr,
+			"err":  err,
+		}).Error("status listener stopped")
+	}()
+}
+
+func (c *CLI) writePlan() error {
+	out := io.Writer(os.Stdout)
+
+	if c.c.String("plan-output") != "" {
+		f, err := os.Create(c.c.String("plan-output"))
+		if err != nil {
+			return errors.Wrap(err, "could not create plan output file")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	err := c.plan.Write(out, c.c.String("plan-format"))
+	if err != nil {
+		return errors.Wrap(err, "could not write plan")
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"entries": len(c.plan.Entries),
+		"output":  c.c.String("plan-output"),
+	}).Info("wrote plan")
+	return nil
+}
+
+// parseProjects reads the projects to clean up and their per-project
+// configuration, falling back to the project of the instance on GCE.
+func (c *CLI) parseProjects() error {
+	var err error
+
+	projectIDs := c.c.StringSlice("project-id")
+	labelSelector := c.c.String("project-label-selector")
+	if len(projectIDs) == 0 && labelSelector == "" && metadata.OnGCE() {
+		projectID, err := metadata.ProjectID()
+		if err != nil {
+			return errors.Wrap(err, "could not get project id from metadata api")
+		}
+		projectIDs = []string{projectID}
+	}
+	if len(projectIDs) == 0 && labelSelector == "" {
+		return errors.New("please provide a project-id or project-label-selector")
+	}
+	c.projectIDs = projectIDs
+
+	c.projectFilters, err = parseProjectFilters(c.c.StringSlice("project-filters"))
+	if err != nil {
+		return err
+	}
+
+	c.projectRateLimitPrefixes, err = parseProjectValues(c.c.StringSlice("project-rate-limit-prefixes"))
+	return err
+}
+
+// setupProjects resolves the projects to clean up for the first time, which
+// needs the rate limiter to be set up.
+func (c *CLI) setupProjects() error {
+	if c.c.String("project-label-selector") != "" {
+		err := c.setupProjectLister(c.c.String("account-json"))
+		if err != nil {
+			c.log.WithField("err", err).Fatal("failed to set up project lister")
+		}
+	}
+
+	projects, err := c.resolveProjects()
+	if err != nil {
+		c.log.WithField("err", err).Fatal("failed to resolve projects")
+	}
+	if len(projects) == 0 {
+		return errors.New("no projects to clean up")
+	}
+	c.projectID = projects[0].id
+	c.projectList = projects
+	c.projectsResolvedAt = time.Now()
+	return nil
+}
+
+// resolveProjects returns the explicitly configured projects plus any
+// matching the project label selector, reusing already known projects so
+// their cleaners are kept across loop iterations.
+func (c *CLI) resolveProjects() ([]*project, error) {
+	projectIDs := append([]string{}, c.projectIDs...)
+
+	if c.projectLister != nil {
+		listed, err := c.projectLister.ListProjects(c.ctx, c.c.String("project-label-selector"))
+		if err != nil {
+			return nil, err
+		}
+		projectIDs = append(projectIDs, listed...)
+	}
+
+	projects := []*project{}
+	seen := map[string]bool{}
+
+	for _, projectID := range projectIDs {
+		if seen[projectID] {
+			continue
+		}
+		seen[projectID] = true
+
+		p, ok := c.projects[projectID]
+		if !ok {
+			p = &project{
+				id:          projectID,
+				log:         c.log.WithField("project", projectID),
+				rateLimiter: c.projectRateLimiter(projectID),
+				filters:     c.projectFilters[projectID],
+			}
+			c.projects[projectID] = p
+
+			p.log.Info("added project")
+		}
+
+		projects = append(projects, p)
+	}
+
+	return projects, nil
+}
+
+func (c *CLI) setupPolicies(filename string) error {
+	if filename == "" {
+		return nil
+	}
+
+	policies, err := newPolicyStore(filename)
+	if err != nil {
+		return errors.Wrap(err, "invalid policy configuration")
+	}
+	c.policies = policies
+
+	c.log.WithField("config", filename).Info("loaded policy configuration")
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			err := c.policies.Reload()
+			if err != nil {
+				c.log.WithFields(logrus.Fields{
+					"config": filename,
+					"err":    err,
+				}).Error("failed to reload policy configuration, keeping previous one")
+				continue
+			}
+
+			c.log.WithField("config", filename).Info("reloaded policy configuration")
+		}
+	}()
+
+	return nil
+}
+
+func (c *CLI) setupProjectLister(accountJSON string) error {
+	rms, err := buildGoogleResourceManagerService(accountJSON)
+	if err != nil {
+		return err
+	}
+	c.projectLister = &resourceManagerProjectLister{rms: rms}
 	return nil
 }
 
 func (c *CLI) setupComputeService(accountJSON string) error {
-	cs, err := buildGoogleComputeService(accountJSON)
+	cs, err := buildGoogleComputeService(accountJSON, c.quotaErrorHandler)
 	c.cs = cs
 	return err
 }
 
+// quotaErrorHandler slows down the rate limiter of a project for the bucket
+// of a call that GCE rejected with a quota error.
+func (c *CLI) quotaErrorHandler(projectID, bucket string) {
+	log := c.log.WithFields(logrus.Fields{
+		"project":           projectID,
+		"rate_limit_bucket": bucket,
+	})
+
+	arl, ok := c.projectRateLimiter(projectID).(ratelimit.AdaptiveRateLimiter)
+	if !ok {
+		log.Warn("quota error")
+		return
+	}
+
+	factor, err := arl.Throttled(rateLimitName(bucket))
+	if err != nil {
+		log.WithField("err", err).Error("failed to throttle rate limiter after quota error")
+		return
+	}
+
+	log.WithField("rate_factor", factor).Warn("quota error, throttling rate limiter")
+}
+
 func (c *CLI) setupStorageClient(accountJSON string) error {
 	sc, err := buildGoogleStorageClient(c.ctx, accountJSON)
 	c.sc = sc
@@ -166,14 +617,181 @@ func (c *CLI) setupLogger() {
 	}
 }
 
-func (c *CLI) setupRateLimiter() {
-	if c.c.String("rate-limit-redis-url") == "" {
-		c.rateLimiter = ratelimit.NewNullRateLimiter()
-		return
+func (c *CLI) setupRateLimiter() error {
+	redisURL := c.c.String("rate-limit-redis-url")
+	algorithm := c.c.String("rate-limit-algorithm")
+
+	limits, err := parseRateLimits(c.c.StringSlice("rate-limits"),
+		defaultRateLimits(uint64(c.c.Int("rate-limit-max-calls")), c.c.Duration("rate-limit-duration")))
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to parse rate limits")
+		return errInvalidRateLimits
 	}
-	c.rateLimiter = ratelimit.NewRateLimiter(
-		c.c.String("rate-limit-redis-url"),
-		c.c.String("rate-limit-prefix"))
+
+	minDuration := time.Millisecond
+	switch algorithm {
+	case rateLimitAlgorithmWatch:
+		// the watch rate limiter works in whole seconds
+		if redisURL != "" {
+			minDuration = time.Second
+		}
+	case rateLimitAlgorithmFixedWindow, rateLimitAlgorithmGCRA, rateLimitAlgorithmSlidingWindow:
+	default:
+		c.log.WithField("rate_limit_algorithm", algorithm).Error("unknown rate limit algorithm")
+		return errInvalidRateLimitAlgorithm
+	}
+
+	for _, bucket := range rateLimitBuckets {
+		if limits[bucket].per < minDuration {
+			c.log.WithFields(logrus.Fields{
+				"rate_limit_algorithm": algorithm,
+				"rate_limit_bucket":    bucket,
+				"rate_limit_duration":  limits[bucket].per,
+				"min_duration":         minDuration,
+			}).Error("rate limit duration is too short for the rate limit algorithm")
+			return errInvalidRateLimitDuration
+		}
+	}
+	c.rateLimits = limits
+
+	minFactor := c.c.Float64("rate-limit-min-factor")
+	if minFactor <= 0 || minFactor > 1 {
+		c.log.WithField("rate_limit_min_factor", minFactor).Error("rate limit min factor must be greater than 0 and at most 1")
+		return errInvalidRateLimitMinFactor
+	}
+
+	if c.c.Duration("rate-limit-recovery") <= 0 {
+		c.log.WithField("rate_limit_recovery", c.c.Duration("rate-limit-recovery")).Error("rate limit recovery must be positive")
+		return errInvalidRateLimitRecovery
+	}
+
+	if redisURL == "" {
+		c.rateLimiter = c.newAdaptiveRateLimiter(ratelimit.NewTokenBucketRateLimiter(), "")
+		return nil
+	}
+
+	err = c.setupRedisPool()
+	if err != nil {
+		return err
+	}
+
+	c.rateLimiter = c.newRedisRateLimiter(c.c.String("rate-limit-prefix"))
+	return nil
+}
+
+// setupLeaderElection sets up leader election through the rate limit Redis if
+// enabled, so that only one replica cleans up at a time.
+func (c *CLI) setupLeaderElection() error {
+	if !c.c.Bool("leader-election") {
+		return nil
+	}
+
+	if c.redisPool == nil {
+		c.log.Error("leader election needs a rate limit redis url")
+		return errInvalidLeaderElection
+	}
+
+	ttl := c.c.Duration("leader-lease-ttl")
+	if ttl < time.Second {
+		c.log.WithField("leader_lease_ttl", ttl).Error("leader lease ttl must be at least 1s")
+		return errInvalidLeaderElection
+	}
+
+	id := c.c.String("leader-id")
+	if id == "" {
+		id = defaultLeaderID()
+	}
+
+	c.leader = newLeaderElection(c.redisPool, c.c.String("leader-lease-key"), id, ttl, c.log, c.status)
+	c.log.WithField("leader_id", id).Info("leader election enabled")
+	return nil
+}
+
+// setupRedisPool creates the pool of Redis connections shared by all
+// Redis-backed rate limiters.
+func (c *CLI) setupRedisPool() error {
+	config := ratelimit.RedisConfig{
+		URL:            c.c.String("rate-limit-redis-url"),
+		SentinelAddrs:  c.c.StringSlice("rate-limit-redis-sentinel-addrs"),
+		SentinelMaster: c.c.String("rate-limit-redis-sentinel-master"),
+		TLSCAFile:      c.c.String("rate-limit-redis-tls-ca-file"),
+		TLSSkipVerify:  c.c.Bool("rate-limit-redis-tls-skip-verify"),
+		PoolMaxActive:  c.c.Int("rate-limit-redis-pool-max-active"),
+		PoolMaxIdle:    c.c.Int("rate-limit-redis-pool-max-idle"),
+	}
+
+	if len(config.SentinelAddrs) > 0 && config.SentinelMaster == "" {
+		c.log.WithField("sentinel_addrs", config.SentinelAddrs).Error("sentinel master name must be set when using sentinel")
+		return errInvalidRateLimitRedis
+	}
+
+	if config.PoolMaxActive < 1 || config.PoolMaxIdle < 1 || config.PoolMaxIdle > config.PoolMaxActive {
+		c.log.WithFields(logrus.Fields{
+			"pool_max_active": config.PoolMaxActive,
+			"pool_max_idle":   config.PoolMaxIdle,
+		}).Error("redis pool sizes must be positive and max idle must not exceed max active")
+		return errInvalidRateLimitRedis
+	}
+
+	if config.TLSSkipVerify {
+		c.log.Warn("not verifying the redis server certificate, which should only be done for local testing")
+	}
+
+	pool, err := ratelimit.NewRedisPool(config)
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to set up redis pool")
+		return errInvalidRateLimitRedis
+	}
+
+	c.redisPool = pool
+	return nil
+}
+
+// newAdaptiveRateLimiter wraps rl so that it slows down on quota errors,
+// sharing the rate through Redis under the given prefix if configured.
+func (c *CLI) newAdaptiveRateLimiter(rl ratelimit.RateLimiter, prefix string) ratelimit.RateLimiter {
+	return ratelimit.NewAdaptiveRateLimiter(rl, c.redisPool, prefix, ratelimit.AdaptiveConfig{
+		MinFactor: c.c.Float64("rate-limit-min-factor"),
+		Recovery:  c.c.Duration("rate-limit-recovery"),
+	})
+}
+
+// newRedisRateLimiter creates a Redis-backed adaptive rate limiter with the
+// given key prefix using the configured algorithm.
+func (c *CLI) newRedisRateLimiter(prefix string) ratelimit.RateLimiter {
+	var rl ratelimit.RateLimiter
+	switch c.c.String("rate-limit-algorithm") {
+	case rateLimitAlgorithmFixedWindow:
+		rl = ratelimit.NewFixedWindowRateLimiter(c.redisPool, prefix)
+	case rateLimitAlgorithmGCRA:
+		rl = ratelimit.NewGCRARateLimiter(c.redisPool, prefix)
+	case rateLimitAlgorithmSlidingWindow:
+		rl = ratelimit.NewSlidingWindowRateLimiter(c.redisPool, prefix)
+	default:
+		rl = ratelimit.NewRateLimiter(c.redisPool, prefix)
+	}
+
+	return c.newAdaptiveRateLimiter(rl, prefix)
+}
+
+// projectRateLimiter returns the rate limiter for the given project, which is
+// the shared one unless the project has its own rate limit prefix.
+func (c *CLI) projectRateLimiter(projectID string) ratelimit.RateLimiter {
+	prefix, ok := c.projectRateLimitPrefixes[projectID]
+	if !ok || c.redisPool == nil {
+		return c.rateLimiter
+	}
+
+	c.rateLimitersMutex.Lock()
+	defer c.rateLimitersMutex.Unlock()
+
+	if rl, ok := c.rateLimiters[prefix]; ok {
+		return rl
+	}
+
+	rl := c.newRedisRateLimiter(prefix)
+	c.rateLimiters[prefix] = rl
+	return rl
 }
 
 func (c *CLI) setupOpenCensus(accountJSON string) error {
@@ -220,50 +838,183 @@ func (c *CLI) setupOpenCensus(accountJSON string) error {
 	return nil
 }
 
-func (c *CLI) cleanupInstances() error {
-	if c.instanceCleaner == nil {
-		filters := c.c.StringSlice("instance-filters")
+func (i *CLI) setupMetrics() {
+	go travismetrics.ReportMemstatsMetrics()
+
+	if i.c.String("librato-email") != "" && i.c.String("librato-token") != "" && i.c.String("librato-source") != "" {
+		i.log.Info("starting librato metrics reporter")
+
+		go librato.Librato(metrics.DefaultRegistry, time.Minute,
+			i.c.String("librato-email"), i.c.String("librato-token"), i.c.String("librato-source"),
+			[]float64{0.50, 0.75, 0.90, 0.95, 0.99, 0.999, 1.0}, time.Millisecond)
+	}
+
+	if i.c.String("prometheus-addr") != "" {
+		addr := i.c.String("prometheus-addr")
+		i.log.WithField("addr", addr).Info("starting prometheus metrics listener")
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", travismetrics.PrometheusHandler())
+
+		go func() {
+			err := http.ListenAndServe(addr, mux)
+			i.log.WithFields(logrus.Fields{
+				"addr": addr,
+				"err":  err,
+			}).Error("prometheus metrics listener stopped")
+		}()
+	}
+}
+
+// setupPlan validates the plan format and collects a plan instead of
+// cleaning up.
+func (c *CLI) setupPlan() error {
+	switch c.c.String("plan-format") {
+	case planFormatJSON, planFormatTable:
+	default:
+		c.log.WithField("plan_format", c.c.String("plan-format")).Error("plan format must be table or json")
+		return errInvalidPlanFormat
+	}
+
+	c.plan = newPlan()
+	c.log.Info("running in plan mode, nothing will be cleaned up")
+	return nil
+}
+
+// setupEntities returns the entities to clean up along with the cleanup func
+// of every known entity.
+func (c *CLI) setupEntities() ([]string, map[string]func(context.Context, *project) error, error) {
+	entities := c.entities
+	if len(entities) == 0 {
+		entities = c.c.StringSlice("entities")
+	}
+	if len(entities) == 0 {
+		entities = []string{"instances"}
+		c.log.WithField("entities", entities).Info("default entities set")
+	}
+
+	entityMap := c.cleanupFuncs()
+
+	for _, entity := range entities {
+		if _, ok := entityMap[entity]; !ok {
+			c.log.WithField("type", entity).Error("unknown entity type")
+			return nil, nil, errInvalidEntity
+		}
+	}
+
+	return entities, entityMap, nil
+}
+
+// cleanupFuncs returns the cleanup func of every known entity.
+func (c *CLI) cleanupFuncs() map[string]func(context.Context, *project) error {
+	return map[string]func(context.Context, *project) error{
+		"instances": c.cleanupInstances,
+		"images":    c.cleanupImages,
+		"disks":     c.cleanupDisks,
+		"snapshots": c.cleanupSnapshots,
+	}
+}
+
+// setupCleaners creates the cleaners of the given entities in every project,
+// so that invalid cleaner configuration fails at startup instead of backing
+// off on every run.
+func (c *CLI) setupCleaners(entities []string) error {
+	if c.c.Int("delete-concurrency") < 1 {
+		c.log.WithField("delete_concurrency", c.c.Int("delete-concurrency")).Error("delete concurrency must be positive")
+		return errInvalidDeleteConcurrency
+	}
+
+	setupFuncs := map[string]func(*project) error{
+		"instances": func(p *project) error {
+			_, err := c.projectInstanceCleaner(p)
+			return err
+		},
+		"images": func(p *project) error {
+			_, err := c.projectImageCleaner(p)
+			return err
+		},
+		"disks": func(p *project) error {
+			_, err := c.projectDiskCleaner(p)
+			return err
+		},
+		"snapshots": func(p *project) error {
+			_, err := c.projectSnapshotCleaner(p)
+			return err
+		},
+	}
+
+	for _, p := range c.projectList {
+		for _, entity := range entities {
+			err := setupFuncs[entity](p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CLI) cleanupInstances(ctx context.Context, p *project) error {
+	cleaner, err := c.projectInstanceCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	return cleaner.Run(ctx)
+}
+
+// projectInstanceCleaner returns the instance cleaner of the given project,
+// creating it on first use.
+func (c *CLI) projectInstanceCleaner(p *project) (*instanceCleaner, error) {
+	if p.instanceCleaner == nil {
+		filters := p.filtersFor("instances", c.c.StringSlice("instance-filters"))
 		if len(filters) == 0 {
 			filters = []string{"name eq ^testing-gce.*"}
-			c.log.WithField("filters", strings.Join(filters, ",")).Info("default filters set")
+			p.log.WithField("filters", strings.Join(filters, ",")).Info("default filters set")
 		}
 
 		cutoffTime := time.Now().UTC().Add(-1 * c.c.Duration("instance-max-age"))
 
 		if time.Now().UTC().Before(cutoffTime) {
-			c.log.WithFields(logrus.Fields{
+			p.log.WithFields(logrus.Fields{
 				"cutoff":  cutoffTime,
 				"max_age": c.c.Duration("instance-max-age"),
 			}).Error("invalid instance max age given")
-			return errInvalidInstancesMaxAge
+			return nil, errInvalidInstancesMaxAge
 		}
 
 		archiveSampleRate := c.c.Int64("archive-sample-rate")
 		if archiveSampleRate <= 0 {
-			c.log.WithFields(logrus.Fields{
+			p.log.WithFields(logrus.Fields{
 				"sample_rate": archiveSampleRate,
 			}).Error("archive sample rate must be positive")
-			return errInvalidArchiveSampleRate
+			return nil, errInvalidArchiveSampleRate
 		}
 
-		c.log.WithFields(logrus.Fields{
+		p.log.WithFields(logrus.Fields{
 			"max_age":    c.c.Duration("instance-max-age"),
 			"tick":       c.c.Duration("rate-tick-limit"),
-			"project_id": c.projectID,
+			"project_id": p.id,
 			"filters":    strings.Join(filters, ","),
+			"zones":      strings.Join(c.c.StringSlice("zones"), ","),
+			"regions":    strings.Join(c.c.StringSlice("regions"), ","),
 			"cutoff":     cutoffTime.Format(time.RFC3339),
 		}).Debug("creating instance cleaner with")
 
-		c.instanceCleaner = &instanceCleaner{
-			ctx: c.ctx,
+		p.instanceCleaner = &instanceCleaner{
 			cs:  c.cs,
 			sc:  c.sc,
-			log: c.log.WithField("component", "instance_cleaner"),
+			log: p.log.WithField("component", "instance_cleaner"),
 
 			rand: rand.New(rand.NewSource(time.Now().UnixNano())),
 
-			projectID: c.projectID,
+			projectID: p.id,
 			filters:   filters,
+			zones:     c.c.StringSlice("zones"),
+			regions:   c.c.StringSlice("regions"),
+
+			protectionLabel: parseProtectionLabel(c.c.String("protection-label")),
 
 			archiveSerial:     c.c.Bool("archive-serial"),
 			archiveBucket:     c.c.String("archive-bucket"),
@@ -272,41 +1023,187 @@ func (c *CLI) cleanupInstances() error {
 
 			CutoffTime: cutoffTime,
 
-			rateLimiter:       c.rateLimiter,
-			rateLimitMaxCalls: uint64(c.c.Int("rate-limit-max-calls")),
-			rateLimitDuration: c.c.Duration("rate-limit-duration"),
+			ttlLabel:       c.c.String("instance-ttl-label"),
+			expiresAtLabel: c.c.String("instance-expires-at-label"),
+
+			policies: c.policies,
+			plan:     c.plan,
+
+			operationTimeout:    c.c.Duration("operation-timeout"),
+			deleteConcurrency:   c.c.Int("delete-concurrency"),
+			shutdownGracePeriod: c.c.Duration("shutdown-grace-period"),
+			listRetryBudget:     c.c.Duration("list-retry-budget"),
+
+			rateLimiter: p.rateLimiter,
+			rateLimits:  c.rateLimits,
 		}
 	}
 
-	c.instanceCleaner.CutoffTime = time.Now().UTC().Add(-1 * c.c.Duration("instance-max-age"))
+	p.instanceCleaner.CutoffTime = time.Now().UTC().Add(-1 * c.c.Duration("instance-max-age"))
 
-	return c.instanceCleaner.Run()
+	return p.instanceCleaner, nil
 }
 
-func (i *CLI) setupMetrics() {
-	go travismetrics.ReportMemstatsMetrics()
+func (c *CLI) cleanupImages(ctx context.Context, p *project) error {
+	cleaner, err := c.projectImageCleaner(p)
+	if err != nil {
+		return err
+	}
 
-	if i.c.String("librato-email") != "" && i.c.String("librato-token") != "" && i.c.String("librato-source") != "" {
-		i.log.Info("starting librato metrics reporter")
+	return cleaner.Run(ctx)
+}
 
-		go librato.Librato(metrics.DefaultRegistry, time.Minute,
-			i.c.String("librato-email"), i.c.String("librato-token"), i.c.String("librato-source"),
-			[]float64{0.50, 0.75, 0.90, 0.95, 0.99, 0.999, 1.0}, time.Millisecond)
+// projectImageCleaner returns the image cleaner of the given project,
+// creating it on first use.
+func (c *CLI) projectImageCleaner(p *project) (*imageCleaner, error) {
+	if p.imageCleaner == nil {
+		filters := p.filtersFor("images", c.c.StringSlice("image-filters"))
+		if len(filters) == 0 {
+			filters = []string{"name eq ^travis-ci.*"}
+			p.log.WithField("filters", strings.Join(filters, ",")).Info("default filters set")
+		}
+
+		p.imageCleaner = newImageCleaner(c.cs,
+			p.log, p.rateLimiter, c.rateLimits,
+			c.c.Duration("operation-timeout"), c.c.Int("delete-concurrency"), p.id,
+			c.c.String("job-board-url"), filters,
+			parseProtectionLabel(c.c.String("protection-label")), c.policies, c.c.Bool("noop"))
+		p.imageCleaner.plan = c.plan
+		p.imageCleaner.shutdownGracePeriod = c.c.Duration("shutdown-grace-period")
+		p.imageCleaner.listRetryBudget = c.c.Duration("list-retry-budget")
+	}
+
+	return p.imageCleaner, nil
+}
+
+func (c *CLI) cleanupDisks(ctx context.Context, p *project) error {
+	cleaner, err := c.projectDiskCleaner(p)
+	if err != nil {
+		return err
 	}
+
+	return cleaner.Run(ctx)
 }
 
-func (c *CLI) cleanupImages() error {
-	if c.imageCleaner == nil {
-		filters := c.c.StringSlice("image-filters")
+// projectDiskCleaner returns the disk cleaner of the given project,
+// creating it on first use.
+func (c *CLI) projectDiskCleaner(p *project) (*diskCleaner, error) {
+	if p.diskCleaner == nil {
+		filters := p.filtersFor("disks", c.c.StringSlice("disk-filters"))
 		if len(filters) == 0 {
-			filters = []string{"name eq ^travis-ci.*"}
-			c.log.WithField("filters", strings.Join(filters, ",")).Info("default filters set")
+			filters = []string{"name eq ^testing-gce.*"}
+			p.log.WithField("filters", strings.Join(filters, ",")).Info("default filters set")
 		}
 
-		c.imageCleaner = newImageCleaner(c.cs,
-			c.log, c.rateLimiter, uint64(c.c.Int("rate-limit-max-calls")), c.c.Duration("rate-limit-duration"), c.projectID,
-			c.c.String("job-board-url"), filters, c.c.Bool("noop"))
+		cutoffTime := time.Now().UTC().Add(-1 * c.c.Duration("disk-max-age"))
+
+		if time.Now().UTC().Before(cutoffTime) {
+			p.log.WithFields(logrus.Fields{
+				"cutoff":  cutoffTime,
+				"max_age": c.c.Duration("disk-max-age"),
+			}).Error("invalid disk max age given")
+			return nil, errInvalidDisksMaxAge
+		}
+
+		p.log.WithFields(logrus.Fields{
+			"max_age":    c.c.Duration("disk-max-age"),
+			"project_id": p.id,
+			"filters":    strings.Join(filters, ","),
+			"cutoff":     cutoffTime.Format(time.RFC3339),
+		}).Debug("creating disk cleaner with")
+
+		p.diskCleaner = &diskCleaner{
+			cs:  c.cs,
+			log: p.log.WithField("component", "disk_cleaner"),
+
+			projectID: p.id,
+			filters:   filters,
+
+			noop: c.c.Bool("noop"),
+			plan: c.plan,
+
+			CutoffTime: cutoffTime,
+
+			operationTimeout:    c.c.Duration("operation-timeout"),
+			deleteConcurrency:   c.c.Int("delete-concurrency"),
+			shutdownGracePeriod: c.c.Duration("shutdown-grace-period"),
+			listRetryBudget:     c.c.Duration("list-retry-budget"),
+
+			rateLimiter: p.rateLimiter,
+			rateLimits:  c.rateLimits,
+		}
+	}
+
+	p.diskCleaner.CutoffTime = time.Now().UTC().Add(-1 * c.c.Duration("disk-max-age"))
+
+	return p.diskCleaner, nil
+}
+
+func (c *CLI) cleanupSnapshots(ctx context.Context, p *project) error {
+	cleaner, err := c.projectSnapshotCleaner(p)
+	if err != nil {
+		return err
 	}
 
-	return c.imageCleaner.Run()
+	return cleaner.Run(ctx)
+}
+
+// projectSnapshotCleaner returns the snapshot cleaner of the given project,
+// creating it on first use.
+func (c *CLI) projectSnapshotCleaner(p *project) (*snapshotCleaner, error) {
+	if p.snapshotCleaner == nil {
+		filters := p.filtersFor("snapshots", c.c.StringSlice("snapshot-filters"))
+
+		cutoffTime := time.Now().UTC().Add(-1 * c.c.Duration("snapshot-max-age"))
+
+		if time.Now().UTC().Before(cutoffTime) {
+			p.log.WithFields(logrus.Fields{
+				"cutoff":  cutoffTime,
+				"max_age": c.c.Duration("snapshot-max-age"),
+			}).Error("invalid snapshot max age given")
+			return nil, errInvalidSnapshotsMaxAge
+		}
+
+		keepLast := c.c.Int("snapshot-keep-last")
+		if keepLast < 0 {
+			p.log.WithFields(logrus.Fields{
+				"keep_last": keepLast,
+			}).Error("snapshot keep last must not be negative")
+			return nil, errInvalidSnapshotsKeepLast
+		}
+
+		p.log.WithFields(logrus.Fields{
+			"max_age":    c.c.Duration("snapshot-max-age"),
+			"keep_last":  keepLast,
+			"project_id": p.id,
+			"filters":    strings.Join(filters, ","),
+			"cutoff":     cutoffTime.Format(time.RFC3339),
+		}).Debug("creating snapshot cleaner with")
+
+		p.snapshotCleaner = &snapshotCleaner{
+			cs:  c.cs,
+			log: p.log.WithField("component", "snapshot_cleaner"),
+
+			projectID: p.id,
+			filters:   filters,
+
+			noop: c.c.Bool("noop"),
+			plan: c.plan,
+
+			KeepLast:   keepLast,
+			CutoffTime: cutoffTime,
+
+			operationTimeout:    c.c.Duration("operation-timeout"),
+			deleteConcurrency:   c.c.Int("delete-concurrency"),
+			shutdownGracePeriod: c.c.Duration("shutdown-grace-period"),
+			listRetryBudget:     c.c.Duration("list-retry-budget"),
+
+			rateLimiter: p.rateLimiter,
+			rateLimits:  c.rateLimits,
+		}
+	}
+
+	p.snapshotCleaner.CutoffTime = time.Now().UTC().Add(-1 * c.c.Duration("snapshot-max-age"))
+
+	return p.snapshotCleaner, nil
 }
@@ -18,8 +18,7 @@ func TestNewCLI(t *testing.T) {
 	assert.Nil(t, c.cs)
 	assert.Nil(t, c.sc)
 	assert.Nil(t, c.rateLimiter)
-	assert.Nil(t, c.instanceCleaner)
-	assert.Nil(t, c.imageCleaner)
+	assert.Empty(t, c.projects)
 }
 
 func TestNewCLI_setupLogger(t *testing.T) {
@@ -38,7 +37,13 @@ func TestNewCLI_setupLogger(t *testing.T) {
 	assert.True(t, ranIt)
 }
 
-func TestNewCLI_setupRateLimiter_null(t *testing.T) {
+// adaptedRateLimiterName returns the type name of the rate limiter wrapped by
+// an adaptive rate limiter.
+func adaptedRateLimiterName(rl interface{}) string {
+	return reflect.ValueOf(rl).Elem().FieldByName("rl").Elem().Elem().Type().Name()
+}
+
+func TestNewCLI_setupRateLimiter_local(t *testing.T) {
 	ranIt := false
 	app := &cli.App{
 		Flags: Flags,
@@ -46,8 +51,7 @@ func TestNewCLI_setupRateLimiter_null(t *testing.T) {
 			gcccli := NewCLI(c)
 			assert.Equal(t, "", c.String("rate-limit-redis-url"))
 			gcccli.setupRateLimiter()
-			tp := reflect.TypeOf(gcccli.rateLimiter)
-			assert.Equal(t, "nullRateLimiter", tp.Name())
+			assert.Equal(t, "tokenBucketRateLimiter", adaptedRateLimiterName(gcccli.rateLimiter))
 			ranIt = true
 			return nil
 		},
@@ -75,6 +79,79 @@ func TestNewCLI_setupRateLimiter_redis(t *testing.T) {
 	assert.True(t, ranIt)
 }
 
+func TestNewCLI_setupRateLimiter_algorithm(t *testing.T) {
+	for algorithm, typeName := range map[string]string{
+		"watch":          "redisRateLimiter",
+		"fixed-window":   "luaFixedWindowRateLimiter",
+		"gcra":           "luaGCRARateLimiter",
+		"sliding-window": "luaSlidingWindowRateLimiter",
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Nil(t, gcccli.setupRateLimiter())
+				assert.Equal(t, typeName, adaptedRateLimiterName(gcccli.rateLimiter))
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run([]string{"foo",
+			"--rate-limit-redis-url", "redis://x:y@z.example.com:6379",
+			"--rate-limit-algorithm", algorithm})
+		assert.True(t, ranIt)
+	}
+}
+
+func TestNewCLI_setupRateLimiter_invalidAlgorithm(t *testing.T) {
+	ranIt := false
+	app := &cli.App{
+		Flags: Flags,
+		Action: func(c *cli.Context) error {
+			gcccli := NewCLI(c)
+			assert.Equal(t, errInvalidRateLimitAlgorithm, gcccli.setupRateLimiter())
+			ranIt = true
+			return nil
+		},
+	}
+	app.Run([]string{"foo", "--rate-limit-algorithm", "leaky"})
+	assert.True(t, ranIt)
+}
+
+func TestNewCLI_setupRateLimiter_duration(t *testing.T) {
+	for _, tc := range []struct {
+		redisURL  string
+		algorithm string
+		duration  string
+		err       error
+	}{
+		{"redis://x:y@z.example.com:6379", "watch", "1s", nil},
+		{"redis://x:y@z.example.com:6379", "watch", "500ms", errInvalidRateLimitDuration},
+		{"redis://x:y@z.example.com:6379", "sliding-window", "500ms", nil},
+		{"redis://x:y@z.example.com:6379", "fixed-window", "1ms", nil},
+		{"redis://x:y@z.example.com:6379", "gcra", "0s", errInvalidRateLimitDuration},
+		{"", "watch", "500ms", nil},
+		{"", "watch", "0s", errInvalidRateLimitDuration},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Equal(t, tc.err, gcccli.setupRateLimiter(), "%q %s %s", tc.redisURL, tc.algorithm, tc.duration)
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run([]string{"foo",
+			"--rate-limit-redis-url", tc.redisURL,
+			"--rate-limit-algorithm", tc.algorithm,
+			"--rate-limit-duration", tc.duration})
+		assert.True(t, ranIt)
+	}
+}
+
 func TestNewCLI_setupStorageClient(t *testing.T) {
 	ranIt := false
 	app := &cli.App{
@@ -114,3 +191,164 @@ func TestNewCLI_setupComputeService(t *testing.T) {
 	app.Run([]string{"foo"})
 	assert.True(t, ranIt)
 }
+
+func TestNewCLI_setupRateLimiter_adaptive(t *testing.T) {
+	for _, tc := range []struct {
+		minFactor string
+		recovery  string
+		err       error
+	}{
+		{"0.1", "10m", nil},
+		{"1", "1s", nil},
+		{"0", "10m", errInvalidRateLimitMinFactor},
+		{"1.5", "10m", errInvalidRateLimitMinFactor},
+		{"0.5", "0s", errInvalidRateLimitRecovery},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Equal(t, tc.err, gcccli.setupRateLimiter(), "%s %s", tc.minFactor, tc.recovery)
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run([]string{"foo",
+			"--rate-limit-min-factor", tc.minFactor,
+			"--rate-limit-recovery", tc.recovery})
+		assert.True(t, ranIt)
+	}
+}
+
+func TestNewCLI_setupRateLimiter_rateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		redisURL   string
+		rateLimits string
+		err        error
+	}{
+		{"", "delete=5/1s", nil},
+		{"", "delete=5", errInvalidRateLimits},
+		{"redis://x:y@z.example.com:6379", "serial-output=2/500ms", errInvalidRateLimitDuration},
+		{"redis://x:y@z.example.com:6379", "serial-output=2/2s", nil},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Equal(t, tc.err, gcccli.setupRateLimiter(), "%q %s", tc.redisURL, tc.rateLimits)
+				if tc.err == nil {
+					assert.Equal(t, uint64(10), gcccli.rateLimits[rateLimitBucketList].maxCalls)
+				}
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run([]string{"foo",
+			"--rate-limit-redis-url", tc.redisURL,
+			"--rate-limits", tc.rateLimits})
+		assert.True(t, ranIt)
+		resetStringSliceFlag("rate-limits")
+	}
+}
+
+// resetStringSliceFlag clears the value of a string slice flag, which would
+// otherwise be appended to by the next app run.
+func resetStringSliceFlag(name string) {
+	for _, f := range Flags {
+		if sf, ok := f.(*cli.StringSliceFlag); ok && sf.Name == name {
+			sf.Value = nil
+		}
+	}
+}
+
+func TestNewCLI_setupRateLimiter_redisConfig(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{}, nil},
+		{[]string{"--rate-limit-redis-pool-max-active", "20", "--rate-limit-redis-pool-max-idle", "20"}, nil},
+		{[]string{"--rate-limit-redis-pool-max-active", "0"}, errInvalidRateLimitRedis},
+		{[]string{"--rate-limit-redis-pool-max-active", "2", "--rate-limit-redis-pool-max-idle", "3"}, errInvalidRateLimitRedis},
+		{[]string{"--rate-limit-redis-sentinel-master", "mymaster", "--rate-limit-redis-sentinel-addrs", "127.0.0.1:26379"}, nil},
+		{[]string{"--rate-limit-redis-sentinel-addrs", "127.0.0.1:26379"}, errInvalidRateLimitRedis},
+		{[]string{"--rate-limit-redis-tls-ca-file", "/does/not/exist.pem"}, errInvalidRateLimitRedis},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Equal(t, tc.err, gcccli.setupRateLimiter(), "%v", tc.args)
+				if tc.err == nil {
+					assert.NotNil(t, gcccli.redisPool)
+				}
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run(append([]string{"foo", "--rate-limit-redis-url", "rediss://x:y@z.example.com:6379"}, tc.args...))
+		assert.True(t, ranIt)
+		resetStringSliceFlag("rate-limit-redis-sentinel-addrs")
+	}
+}
+
+func TestNewCLI_setupLeaderElection(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		err    error
+		leader bool
+	}{
+		{[]string{}, nil, false},
+		{[]string{"--leader-election"}, errInvalidLeaderElection, false},
+		{[]string{"--leader-election", "--rate-limit-redis-url", "redis://z.example.com:6379"}, nil, true},
+		{[]string{"--leader-election", "--rate-limit-redis-url", "redis://z.example.com:6379", "--leader-lease-ttl", "500ms"}, errInvalidLeaderElection, false},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				assert.Nil(t, gcccli.setupRateLimiter())
+				assert.Equal(t, tc.err, gcccli.setupLeaderElection(), "%v", tc.args)
+				assert.Equal(t, tc.leader, gcccli.leader != nil, "%v", tc.args)
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run(append([]string{"foo"}, tc.args...))
+		assert.True(t, ranIt)
+	}
+}
+
+func TestCLI_setupCleaners(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{}, nil},
+		{[]string{"--archive-sample-rate", "0"}, errInvalidArchiveSampleRate},
+		{[]string{"--disk-max-age", "-1h"}, errInvalidDisksMaxAge},
+		{[]string{"--snapshot-keep-last", "-1"}, errInvalidSnapshotsKeepLast},
+	} {
+		ranIt := false
+		app := &cli.App{
+			Flags: Flags,
+			Action: func(c *cli.Context) error {
+				gcccli := NewCLI(c)
+				gcccli.log.Level = logrus.FatalLevel
+				gcccli.projectList = []*project{
+					{id: "foo-project", log: gcccli.log.WithField("project", "foo-project")},
+				}
+				err := gcccli.setupCleaners([]string{"instances", "images", "disks", "snapshots"})
+				assert.Equal(t, tc.err, err, "%v", tc.args)
+				ranIt = true
+				return nil
+			},
+		}
+		app.Run(append([]string{"foo"}, tc.args...))
+		assert.True(t, ranIt)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/travis-ci/gcloud-cleanup"
@@ -13,9 +14,15 @@ func main() {
 		Version:   gcloudcleanup.VersionString,
 		Copyright: gcloudcleanup.CopyrightString,
 		Flags:     gcloudcleanup.Flags,
+		Commands:  gcloudcleanup.Commands,
 		Action: func(c *cli.Context) error {
 			return gcloudcleanup.NewCLI(c).Run()
 		},
 	}
-	app.Run(os.Args)
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,379 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v2"
+)
+
+var (
+	errInvalidArgs       = errors.New("invalid arguments")
+	errMultipleProjects  = errors.New("more than one project")
+	errResourceNotFound  = errors.New("resource not found")
+	errResourceAmbiguous = errors.New("resource name found in several zones")
+	errResourceProtected = errors.New("resource is protected")
+)
+
+// Commands are the gcloud-cleanup subcommands. They all take the global Flags,
+// given either before or after the command, e.g.
+// `gcloud-cleanup list --project-id foo images`. Without a command,
+// gcloud-cleanup runs as before.
+var Commands = []*cli.Command{
+	{
+		Name:   "run",
+		Usage:  "clean up every entity on its schedule until stopped (default)",
+		Flags:  Flags,
+		Before: inheritFlags,
+		Action: func(c *cli.Context) error {
+			return NewCLI(c).Run()
+		},
+	},
+	{
+		Name:   "plan",
+		Usage:  "report what every entity would clean up once, without cleaning up",
+		Flags:  Flags,
+		Before: inheritFlags,
+		Action: func(c *cli.Context) error {
+			return NewCLI(c).Plan()
+		},
+	},
+	{
+		Name:      "list",
+		Usage:     "list the resources of an entity that would be cleaned up and why",
+		ArgsUsage: "<entity>",
+		Flags:     Flags,
+		Before:    inheritFlags,
+		Action: func(c *cli.Context) error {
+			if err := checkArgs(c, 1); err != nil {
+				return err
+			}
+			return NewCLI(c).List(c.Args().Get(0))
+		},
+	},
+	{
+		Name:      "delete",
+		Usage:     "delete a single resource of an entity, rate limited like a cleanup",
+		ArgsUsage: "<entity> <name>",
+		Flags:     Flags,
+		Before:    inheritFlags,
+		Action: func(c *cli.Context) error {
+			if err := checkArgs(c, 2); err != nil {
+				return err
+			}
+			return NewCLI(c).Delete(c.Args().Get(0), c.Args().Get(1))
+		},
+	},
+	{
+		Name:      "archive",
+		Usage:     "archive the serial port output of an instance to the archive bucket",
+		ArgsUsage: "<instance>",
+		Flags:     Flags,
+		Before:    inheritFlags,
+		Action: func(c *cli.Context) error {
+			if err := checkArgs(c, 1); err != nil {
+				return err
+			}
+			return NewCLI(c).Archive(c.Args().Get(0))
+		},
+	},
+}
+
+// inheritFlags copies the flags given before the command to the command's own
+// flags, unless they are given again after it, as the command's flags would
+// otherwise shadow them.
+func inheritFlags(c *cli.Context) error {
+	lineage := c.Lineage()
+	if len(lineage) < 2 {
+		return nil
+	}
+	parent := lineage[1]
+
+	local := map[string]bool{}
+	for _, name := range c.LocalFlagNames() {
+		local[name] = true
+	}
+
+	sliceFlags := map[string]bool{}
+	for _, f := range Flags {
+		if sf, ok := f.(*cli.StringSliceFlag); ok {
+			sliceFlags[sf.Name] = true
+		}
+	}
+
+	for _, name := range parent.LocalFlagNames() {
+		if local[name] {
+			continue
+		}
+
+		value := parent.String(name)
+		if sliceFlags[name] {
+			value = cli.NewStringSlice(parent.StringSlice(name)...).Serialized()
+		}
+
+		err := c.Set(name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkArgs(c *cli.Context, n int) error {
+	if c.NArg() != n {
+		return errors.Wrapf(errInvalidArgs, "usage: %s %s", c.Command.Name, c.Command.ArgsUsage)
+	}
+	return nil
+}
+
+// Plan runs every configured entity once in plan mode in every project and
+// writes the plan. There is no leader election and no status or metrics
+// listener, so it can run next to a deployed gcloud-cleanup. Running with the
+// plan flag ends up here as well.
+func (c *CLI) Plan() error {
+	err := c.setupOneOffProjects()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupPolicies(c.c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	err = c.setupPlan()
+	if err != nil {
+		return err
+	}
+
+	entities, entityMap, err := c.setupEntities()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupCleaners(entities)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		for _, p := range c.projectList {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
+			}
+
+			err = entityMap[entity](c.ctx, p)
+			if err != nil {
+				p.log.WithFields(logrus.Fields{
+					"err":  err,
+					"type": entity,
+				}).Error("failed to plan cleanup")
+				return err
+			}
+		}
+	}
+
+	return c.writePlan()
+}
+
+// List reports the resources of the given entity that would be cleaned up,
+// along with the reason and matching rule.
+func (c *CLI) List(entity string) error {
+	if _, ok := c.cleanupFuncs()[entity]; !ok {
+		c.log.WithField("type", entity).Error("unknown entity type")
+		return errInvalidEntity
+	}
+
+	c.entities = []string{entity}
+	return c.Plan()
+}
+
+// Delete deletes a single resource of the given entity through its cleaner,
+// waiting for the rate limiter and the delete operation. Protected resources
+// are not deleted.
+func (c *CLI) Delete(entity, name string) error {
+	deleteFuncs := map[string]func(context.Context, *project, string) error{
+		"instances": c.deleteInstance,
+		"images":    c.deleteImage,
+		"disks":     c.deleteDisk,
+		"snapshots": c.deleteSnapshot,
+	}
+
+	f, ok := deleteFuncs[entity]
+	if !ok {
+		c.log.WithField("type", entity).Error("unknown entity type")
+		return errInvalidEntity
+	}
+
+	p, err := c.setupOneOff()
+	if err != nil {
+		return err
+	}
+
+	log := p.log.WithFields(logrus.Fields{
+		"type": entity,
+		"name": name,
+	})
+
+	err = f(c.ctx, p, name)
+	if err != nil {
+		log.WithField("err", err).Error("failed to delete resource")
+		return err
+	}
+
+	log.WithField("noop", c.c.Bool("noop")).Info("deleted resource")
+	return nil
+}
+
+// Archive uploads the serial port output of an instance to the archive
+// bucket, regardless of the archive sample rate.
+func (c *CLI) Archive(name string) error {
+	p, err := c.setupOneOff()
+	if err != nil {
+		return err
+	}
+
+	err = c.setupStorageClient(c.c.String("account-json"))
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to set up storage client")
+		return err
+	}
+
+	log := p.log.WithField("instance", name)
+
+	ic, err := c.projectInstanceCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	inst, err := ic.getInstance(c.ctx, name)
+	if err == nil {
+		err = ic.uploadSerialConsoleOutput(c.ctx, inst)
+	}
+	if err != nil {
+		log.WithField("err", err).Error("failed to archive serial port output")
+		return err
+	}
+
+	log.WithField("bucket", ic.archiveBucket).Info("archived serial port output")
+	return nil
+}
+
+// setupOneOff sets up what the delete and archive commands need to act on a
+// resource in a single project.
+func (c *CLI) setupOneOff() (*project, error) {
+	err := c.setupOneOffProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.projectList) > 1 {
+		c.log.WithField("projects", len(c.projectList)).Error("please provide a single project-id")
+		return nil, errMultipleProjects
+	}
+
+	return c.projectList[0], nil
+}
+
+// setupOneOffProjects sets up what the commands need to make a single pass
+// over the projects, leaving out the status server, metrics and leader
+// election. An already set compute service is kept.
+func (c *CLI) setupOneOffProjects() error {
+	err := c.parseProjects()
+	if err != nil {
+		return err
+	}
+
+	c.status = newRunStatus(c.c.Duration("health-stall-timeout"), time.Now())
+
+	c.setupLogger()
+	err = c.setupRateLimiter()
+	if err != nil {
+		return err
+	}
+	c.setupSignals()
+
+	err = c.setupProjects()
+	if err != nil {
+		return err
+	}
+
+	if c.cs != nil {
+		return nil
+	}
+
+	err = c.setupComputeService(c.c.String("account-json"))
+	if err != nil {
+		c.log.WithField("err", err).Error("failed to set up compute service")
+		return err
+	}
+
+	return nil
+}
+
+func (c *CLI) deleteInstance(ctx context.Context, p *project, name string) error {
+	ic, err := c.projectInstanceCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	inst, err := ic.getInstance(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if inst.DeletionProtection || ic.protectionLabel.matches(inst.Labels) {
+		return errors.Wrapf(errResourceProtected, "instance %s", name)
+	}
+
+	return ic.deleteInstance(ctx, inst)
+}
+
+func (c *CLI) deleteImage(ctx context.Context, p *project, name string) error {
+	ic, err := c.projectImageCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	image, err := ic.getImage(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if ic.protectionLabel.matches(image.Labels) {
+		return errors.Wrapf(errResourceProtected, "image %s", name)
+	}
+
+	return ic.deleteImage(ctx, image)
+}
+
+func (c *CLI) deleteDisk(ctx context.Context, p *project, name string) error {
+	dc, err := c.projectDiskCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	disk, err := dc.getDisk(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return dc.deleteDisk(ctx, disk)
+}
+
+func (c *CLI) deleteSnapshot(ctx context.Context, p *project, name string) error {
+	sc, err := c.projectSnapshotCleaner(p)
+	if err != nil {
+		return err
+	}
+
+	snap, err := sc.getSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return sc.deleteSnapshot(ctx, snap)
+}
@@ -0,0 +1,285 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	compute "google.golang.org/api/compute/v1"
+	"gopkg.in/urfave/cli.v2"
+
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+func TestCommands_args(t *testing.T) {
+	for _, args := range [][]string{
+		{"list"},
+		{"list", "images", "disks"},
+		{"delete", "images"},
+		{"archive"},
+	} {
+		app := &cli.App{Flags: Flags, Commands: Commands}
+		err := app.Run(append([]string{"foo"}, args...))
+		assert.Equal(t, errInvalidArgs, errors.Cause(err), strings.Join(args, " "))
+	}
+}
+
+func TestCommands_flags(t *testing.T) {
+	for _, args := range [][]string{
+		{"run", "--noop", "--project-id", "foo-project"},
+		{"--noop", "--project-id", "foo-project", "run"},
+		{"--noop", "run", "--project-id", "foo-project"},
+		{"--noop=false", "--project-id", "foo-project", "run", "--noop"},
+	} {
+		ranIt := false
+		run := *Commands[0]
+		run.Action = func(c *cli.Context) error {
+			assert.True(t, c.Bool("noop"), strings.Join(args, " "))
+			assert.Equal(t, []string{"foo-project"}, c.StringSlice("project-id"), strings.Join(args, " "))
+			ranIt = true
+			return nil
+		}
+
+		app := &cli.App{Flags: Flags, Commands: []*cli.Command{&run}}
+		assert.Nil(t, app.Run(append([]string{"foo"}, args...)))
+		assert.True(t, ranIt, strings.Join(args, " "))
+		resetStringSliceFlag("project-id")
+	}
+}
+
+func TestCommands_invalidEntity(t *testing.T) {
+	for _, args := range [][]string{
+		{"list", "volumes"},
+		{"delete", "volumes", "test-vol-0"},
+	} {
+		app := &cli.App{Flags: Flags, Commands: Commands}
+		err := app.Run(append([]string{"foo"}, args...))
+		assert.Equal(t, errInvalidEntity, err, strings.Join(args, " "))
+	}
+}
+
+func TestCLI_deleteInstance(t *testing.T) {
+	deleted := []string{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/aggregated/instances",
+		func(w http.ResponseWriter, req *http.Request) {
+			instances := map[string][]interface{}{
+				"name eq ^test-vm-0$": {
+					map[string]string{"name": "test-vm-0", "zone": "zones/us-central1-a"},
+				},
+				"name eq ^test-vm-1$": {
+					map[string]interface{}{
+						"name":   "test-vm-1",
+						"zone":   "zones/us-central1-a",
+						"labels": map[string]string{"gcloud-cleanup-protect": "true"},
+					},
+				},
+				"name eq ^test-vm-2$": {
+					map[string]string{"name": "test-vm-2", "zone": "zones/us-central1-a"},
+					map[string]string{"name": "test-vm-2", "zone": "zones/us-central1-b"},
+				},
+			}[req.URL.Query().Get("filter")]
+
+			err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/us-central1-a": map[string]interface{}{"instances": instances},
+				},
+			})
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc(
+		"/foo-project/zones/us-central1-a/instances/",
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "DELETE", req.Method)
+			deleted = append(deleted, req.URL.Path)
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	ranIt := false
+	app := &cli.App{
+		Flags: Flags,
+		Action: func(c *cli.Context) error {
+			gcccli := NewCLI(c)
+			gcccli.log.Level = logrus.FatalLevel
+			gcccli.cs = cs
+			gcccli.rateLimits = defaultRateLimits(10, time.Second)
+
+			p := &project{
+				id:          "foo-project",
+				log:         gcccli.log.WithField("project", "foo-project"),
+				rateLimiter: ratelimit.NewNullRateLimiter(),
+			}
+			ctx := context.Background()
+
+			assert.Nil(t, gcccli.deleteInstance(ctx, p, "test-vm-0"))
+			assert.Equal(t, errResourceProtected, errors.Cause(gcccli.deleteInstance(ctx, p, "test-vm-1")))
+			assert.Equal(t, errResourceAmbiguous, errors.Cause(gcccli.deleteInstance(ctx, p, "test-vm-2")))
+			assert.Equal(t, errResourceNotFound, errors.Cause(gcccli.deleteInstance(ctx, p, "test-vm-3")))
+			ranIt = true
+			return nil
+		},
+	}
+	app.Run([]string{"foo", "--protection-label", "gcloud-cleanup-protect=true"})
+	assert.True(t, ranIt)
+	assert.Equal(t, []string{"/foo-project/zones/us-central1-a/instances/test-vm-0"}, deleted)
+}
+
+func TestCLI_deleteImage(t *testing.T) {
+	deleted := false
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/global/images/travis-test-image-0",
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case "GET":
+				fmt.Fprintf(w, `{"name": "travis-test-image-0"}`)
+			case "DELETE":
+				deleted = true
+				fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+			}
+		})
+	mux.HandleFunc(
+		"/foo-project/global/images/travis-test-image-1",
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	ranIt := false
+	app := &cli.App{
+		Flags: Flags,
+		Action: func(c *cli.Context) error {
+			gcccli := NewCLI(c)
+			gcccli.log.Level = logrus.FatalLevel
+			gcccli.cs = cs
+			gcccli.rateLimits = defaultRateLimits(10, time.Second)
+
+			p := &project{
+				id:          "foo-project",
+				log:         gcccli.log.WithField("project", "foo-project"),
+				rateLimiter: ratelimit.NewNullRateLimiter(),
+			}
+			ctx := context.Background()
+
+			assert.Nil(t, gcccli.deleteImage(ctx, p, "travis-test-image-0"))
+			assert.Equal(t, errResourceNotFound, errors.Cause(gcccli.deleteImage(ctx, p, "travis-test-image-1")))
+			ranIt = true
+			return nil
+		},
+	}
+	app.Run([]string{"foo"})
+	assert.True(t, ranIt)
+	assert.True(t, deleted)
+}
+
+func TestCLI_listWithoutLeaderLease(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	// another replica holds the leader lease
+	assert.Nil(t, mr.Set("gcloud-cleanup:leader", "other-replica"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/aggregated/instances",
+		func(w http.ResponseWriter, req *http.Request) {
+			err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/us-central1-a": map[string]interface{}{
+						"instances": []interface{}{
+							map[string]string{
+								"name":              "test-vm-0",
+								"status":            "TERMINATED",
+								"creationTimestamp": time.Now().Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+						},
+					},
+				},
+			})
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	out, err := ioutil.TempFile("", "gcloud-cleanup-plan")
+	assert.Nil(t, err)
+	out.Close()
+	defer os.Remove(out.Name())
+
+	ranIt := false
+	app := &cli.App{
+		Flags: Flags,
+		Action: func(c *cli.Context) error {
+			gcccli := NewCLI(c)
+			gcccli.log.Level = logrus.FatalLevel
+			gcccli.cs = cs
+
+			assert.Nil(t, gcccli.List("instances"))
+			assert.Nil(t, gcccli.leader)
+			ranIt = true
+			return nil
+		},
+	}
+	app.Run([]string{"foo",
+		"--project-id", "foo-project",
+		"--leader-election",
+		"--leader-id", "this-replica",
+		"--rate-limit-redis-url", "redis://" + mr.Addr(),
+		"--plan-format", "json",
+		"--plan-output", out.Name()})
+	assert.True(t, ranIt)
+
+	plan, err := ioutil.ReadFile(out.Name())
+	assert.Nil(t, err)
+	assert.Contains(t, string(plan), "test-vm-0")
+
+	holder, err := mr.Get("gcloud-cleanup:leader")
+	assert.Nil(t, err)
+	assert.Equal(t, "other-replica", holder)
+}
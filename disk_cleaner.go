@@ -0,0 +1,349 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	travismetrics "github.com/travis-ci/gcloud-cleanup/metrics"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+var errRegionalDisk = errors.New("regional disks are not supported")
+
+type diskCleaner struct {
+	cs  *compute.Service
+	log *logrus.Entry
+
+	projectID string
+	filters   []string
+
+	noop bool
+
+	CutoffTime time.Time
+
+	// plan collects the disks that would be deleted instead of deleting them
+	plan *plan
+
+	operationTimeout  time.Duration
+	deleteConcurrency int
+
+	// listRetryBudget is how long failing list calls are retried before
+	// giving up on the run
+	listRetryBudget time.Duration
+
+	// shutdownGracePeriod is how long in-flight deletions may keep running
+	// once the context passed to Run is done
+	shutdownGracePeriod time.Duration
+
+	rateLimiter ratelimit.RateLimiter
+	rateLimits  rateLimits
+
+	// lastCounts holds the counts of the last run
+	lastCounts map[string]int64
+}
+
+type diskDeletionRequest struct {
+	Disk   *compute.Disk
+	Reason string
+}
+
+func (dc *diskCleaner) Run(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "DiskCleanerRun")
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("app", "gcloud-cleanup"),
+	)
+
+	dc.log.WithFields(logrus.Fields{
+		"project":     dc.projectID,
+		"cutoff_time": dc.CutoffTime.Format(time.RFC3339),
+		"filters":     strings.Join(dc.filters, ","),
+	}).Info("running disk cleanup")
+
+	diskChan := make(chan *diskDeletionRequest)
+	errChan := make(chan error)
+
+	go dc.fetchDisksToDelete(ctx, diskChan, errChan)
+	fetchErrChan := collectFetchErrors(dc.log, "error during disk fetch", errChan)
+
+	nDeleted := int64(0)
+	nFailed := int64(0)
+	nSkipped := int64(0)
+
+	workCtx, cancel := withGracePeriod(ctx, dc.shutdownGracePeriod)
+	defer cancel()
+
+	runWorkers(workCtx, dc.deleteConcurrency, "DiskDeleteWorker", func(workCtx context.Context, worker int) {
+		for req := range diskChan {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&nSkipped, 1)
+				continue
+			}
+
+			if dc.plan != nil {
+				dc.plan.add(dc.projectID, "disks", req.Disk.Name, req.Disk.Zone,
+					req.Disk.CreationTimestamp, req.Reason, "", policyActionDelete,
+					req.Disk.Labels, time.Now().UTC())
+				continue
+			}
+
+			err := dc.deleteDisk(workCtx, req.Disk)
+
+			if err != nil {
+				atomic.AddInt64(&nFailed, 1)
+				travismetrics.ResourceFailed(dc.projectID, "disks", "deleted", filepath.Base(req.Disk.Zone))
+
+				dc.log.WithFields(logrus.Fields{
+					"err":    err,
+					"disk":   req.Disk.Name,
+					"worker": worker,
+				}).Warn("failed to delete disk")
+				continue
+			}
+
+			atomic.AddInt64(&nDeleted, 1)
+			travismetrics.ResourceCleaned(dc.projectID, "disks", "deleted", req.Reason, filepath.Base(req.Disk.Zone))
+
+			dc.log.WithFields(logrus.Fields{
+				"disk":   req.Disk.Name,
+				"reason": req.Reason,
+				"worker": worker,
+			}).Info("deleted")
+		}
+	})
+
+	dc.lastCounts = map[string]int64{
+		"deleted": nDeleted,
+		"failed":  nFailed,
+		"skipped": nSkipped,
+	}
+
+	projectCounter(dc.projectID, "disks.deleted", nDeleted)
+	projectCounter(dc.projectID, "disks.failed", nFailed)
+	dc.l2met("measure#disks.failed", int(nFailed), "counted failed disk deletions")
+	dc.l2met("measure#disks.deleted", int(nDeleted), "done running disk cleanup")
+
+	if nSkipped > 0 {
+		dc.log.WithField("skipped", nSkipped).Warn("skipped disks due to shutdown")
+	}
+
+	fetchErr := <-fetchErrChan
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	return ctx.Err()
+}
+
+func (dc *diskCleaner) fetchDisksToDelete(ctx context.Context, diskChan chan *diskDeletionRequest, errChan chan error) {
+	ctx, span := trace.StartSpan(ctx, "FetchDisksToDelete")
+	defer span.End()
+
+	defer close(errChan)
+	defer close(diskChan)
+
+	listCall := dc.cs.Disks.AggregatedList(dc.projectID)
+	for _, filter := range dc.filters {
+		listCall.Filter(filter)
+	}
+
+	pageTok := ""
+	statusCounts := map[string]int{}
+	nDisks := 0
+	nUnattached := 0
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if pageTok != "" {
+			listCall.PageToken(pageTok)
+		}
+
+		dc.log.WithField("page_token", pageTok).Debug("fetching disks aggregated list")
+
+		var resp *compute.DiskAggregatedList
+		err := retryListCall(ctx, dc.log, dc.listRetryBudget, func() (err error) {
+			if err = dc.rateLimits.wait(ctx, dc.rateLimiter, rateLimitBucketList); err != nil {
+				return
+			}
+			resp, err = listCall.Context(ctx).Do()
+			return
+		})
+
+		if err != nil {
+			errChan <- errors.Wrap(err, "could not list disks")
+			return
+		}
+
+		dc.log.WithField("zones", len(resp.Items)).Debug("checking aggregated disk results")
+
+		for zone, list := range resp.Items {
+			dc.log.WithFields(logrus.Fields{
+				"zone":  zone,
+				"disks": len(list.Disks),
+			}).Debug("checking disk results in zone")
+
+			for _, disk := range list.Disks {
+				nDisks++
+
+				log := dc.log.WithFields(logrus.Fields{
+					"disk": disk.Name,
+				})
+
+				statusCounts[disk.Status]++
+
+				if disk.Region != "" {
+					log.WithField("region", disk.Region).Debug("skipping regional disk")
+					continue
+				}
+
+				if disk.Status == "CREATING" || disk.Status == "DELETING" {
+					log.WithField("status", disk.Status).Debug("skipping disk being created or deleted")
+					continue
+				}
+
+				if len(disk.Users) > 0 {
+					log.WithField("users", strings.Join(disk.Users, ",")).Debug("skipping attached disk")
+					continue
+				}
+
+				nUnattached++
+
+				ts, err := time.Parse(time.RFC3339, disk.CreationTimestamp)
+
+				if err != nil {
+					log.WithField("err", err).Warn("failed to parse creation timestamp")
+					continue
+				}
+
+				ts = ts.UTC()
+
+				log.WithFields(logrus.Fields{
+					"orig":   disk.CreationTimestamp,
+					"parsed": ts.Format(time.RFC3339),
+				}).Debug("parsed and adjusted creation timestamp")
+
+				if ts.Before(dc.CutoffTime) {
+					log.WithFields(logrus.Fields{
+						"created": ts.Format(time.RFC3339),
+						"cutoff":  dc.CutoffTime.Format(time.RFC3339),
+					}).Debug("sending disk for deletion")
+
+					select {
+					case diskChan <- &diskDeletionRequest{Disk: disk, Reason: "unattached"}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+
+				log.Debug("skipping disk")
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			dc.log.Debug("no next page, breaking out of loop")
+			break
+		}
+
+		dc.log.Debug("continuing to next page")
+		pageTok = resp.NextPageToken
+	}
+
+	for status, count := range statusCounts {
+		key := fmt.Sprintf("gauge#disks.status.%s", status)
+		dc.l2met(key, count, "counted disks with status")
+	}
+	travismetrics.ResourceStatuses(dc.projectID, "disks", statusCounts)
+
+	dc.l2met("gauge#disks.unattached", nUnattached, "counted unattached disks")
+	dc.l2met("gauge#disks.count", nDisks, "done checking all disks")
+}
+
+// getDisk looks up a disk by name across all zones.
+func (dc *diskCleaner) getDisk(ctx context.Context, name string) (*compute.Disk, error) {
+	listCall := dc.cs.Disks.AggregatedList(dc.projectID).
+		Filter(fmt.Sprintf("name eq ^%s$", regexp.QuoteMeta(name)))
+
+	var found []*compute.Disk
+	err := retryListCall(ctx, dc.log, dc.listRetryBudget, func() error {
+		found = nil
+		if err := dc.rateLimits.wait(ctx, dc.rateLimiter, rateLimitBucketList); err != nil {
+			return err
+		}
+		return listCall.Pages(ctx, func(resp *compute.DiskAggregatedList) error {
+			for _, list := range resp.Items {
+				found = append(found, list.Disks...)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list disks")
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, errors.Wrapf(errResourceNotFound, "disk %s", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, errors.Wrapf(errResourceAmbiguous, "disk %s", name)
+	}
+}
+
+func (dc *diskCleaner) deleteDisk(ctx context.Context, disk *compute.Disk) error {
+	ctx, span := trace.StartSpan(ctx, "DeleteDisk")
+	defer span.End()
+
+	if dc.noop {
+		dc.log.WithField("disk", disk.Name).Debug("not really deleting disk")
+		return nil
+	}
+
+	if disk.Zone == "" {
+		return errors.Wrapf(errRegionalDisk, "disk %s", disk.Name)
+	}
+
+	zone := filepath.Base(disk.Zone)
+
+	if err := dc.rateLimits.wait(ctx, dc.rateLimiter, rateLimitBucketDelete); err != nil {
+		return err
+	}
+	op, err := dc.cs.Disks.Delete(dc.projectID, zone, disk.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	op, err = waitForOperation(ctx, op, dc.operationTimeout, func(ctx context.Context, name string) (*compute.Operation, error) {
+		if err := dc.rateLimits.wait(ctx, dc.rateLimiter, rateLimitBucketOperations); err != nil {
+			return nil, err
+		}
+		return dc.cs.ZoneOperations.Get(dc.projectID, zone, name).Context(ctx).Do()
+	})
+
+	dc.log.WithFields(logrus.Fields{
+		"disk":      disk.Name,
+		"operation": op.Name,
+		"status":    op.Status,
+	}).Debug("finished waiting for delete operation")
+
+	return err
+}
+
+func (dc *diskCleaner) l2met(name string, n int, msg string) {
+	dc.log.WithField(name, n).Info(msg)
+}
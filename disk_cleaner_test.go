@@ -0,0 +1,149 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+func TestDiskCleaner_Run(t *testing.T) {
+	deleted := map[string]bool{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/aggregated/disks",
+		func(w http.ResponseWriter, req *http.Request) {
+			body := map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/us-central1-a": map[string]interface{}{
+						"disks": []interface{}{
+							map[string]interface{}{
+								"name":              "test-disk-0",
+								"status":            "READY",
+								"creationTimestamp": time.Now().Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]interface{}{
+								"name":              "test-disk-1",
+								"status":            "READY",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]interface{}{
+								"name":              "test-disk-2",
+								"status":            "READY",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"zone":              "zones/us-central1-a",
+								"users": []string{
+									"zones/us-central1-a/instances/test-vm-2",
+								},
+							},
+							map[string]interface{}{
+								"name":              "test-disk-3",
+								"status":            "DELETING",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"zone":              "zones/us-central1-a",
+							},
+						},
+					},
+					"regions/us-central1": map[string]interface{}{
+						"disks": []interface{}{
+							map[string]interface{}{
+								"name":              "test-disk-4",
+								"status":            "READY",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"region":            "regions/us-central1",
+							},
+						},
+					},
+				},
+			}
+			err := json.NewEncoder(w).Encode(body)
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc(
+		"/foo-project/zones/us-central1-a/disks/test-disk-1",
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, req.Method, "DELETE")
+			deleted["test-disk-1"] = true
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+	if os.Getenv("GCLOUD_CLEANUP_TEST_DEBUG") != "" {
+		log.Level = logrus.DebugLevel
+	}
+
+	dc := &diskCleaner{
+		cs:                cs,
+		log:               log.WithField("test", "yep"),
+		rateLimiter:       ratelimit.NewNullRateLimiter(),
+		rateLimits:        defaultRateLimits(10, time.Second),
+		CutoffTime:        time.Now().Add(-1 * time.Hour),
+		projectID:         "foo-project",
+		filters:           []string{"name eq ^test.*"},
+		noop:              false,
+		deleteConcurrency: 4,
+	}
+
+	err = dc.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"test-disk-1": true}, deleted)
+}
+
+func TestDiskCleaner_Run_cancelled(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	dc := &diskCleaner{
+		cs:          cs,
+		log:         log.WithField("test", "yep"),
+		rateLimiter: ratelimit.NewNullRateLimiter(),
+		rateLimits:  defaultRateLimits(10, time.Second),
+		CutoffTime:  time.Now().Add(-1 * time.Hour),
+		projectID:   "foo-project",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = dc.Run(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,86 @@
+package gcloudcleanup
+
+import (
+	"sync"
+	"time"
+)
+
+// entityFailures tracks the consecutive failures of an entity cleanup in a
+// single project and when it may be retried.
+type entityFailures struct {
+	consecutive int
+	retryAt     time.Time
+}
+
+// entityBackoff decides when failed entity cleanups are retried. Each
+// consecutive failure doubles the delay, starting at base and capped at max.
+// It is safe for use by the schedulers of several entities at once.
+type entityBackoff struct {
+	sync.Mutex
+
+	base time.Duration
+	max  time.Duration
+
+	failures map[string]*entityFailures
+}
+
+func newEntityBackoff(base, max time.Duration) *entityBackoff {
+	return &entityBackoff{
+		base:     base,
+		max:      max,
+		failures: map[string]*entityFailures{},
+	}
+}
+
+func (eb *entityBackoff) key(entity, projectID string) string {
+	return projectID + "/" + entity
+}
+
+// ready returns whether the entity cleanup in the given project may run, and
+// if not, when it may be retried.
+func (eb *entityBackoff) ready(entity, projectID string, now time.Time) (bool, time.Time) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	f, ok := eb.failures[eb.key(entity, projectID)]
+	if !ok || !now.Before(f.retryAt) {
+		return true, time.Time{}
+	}
+	return false, f.retryAt
+}
+
+// failure records a failed entity cleanup and returns the number of
+// consecutive failures along with the time of the next attempt.
+func (eb *entityBackoff) failure(entity, projectID string, now time.Time) (int, time.Time) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	key := eb.key(entity, projectID)
+
+	f, ok := eb.failures[key]
+	if !ok {
+		f = &entityFailures{}
+		eb.failures[key] = f
+	}
+
+	f.consecutive++
+
+	delay := eb.base
+	for i := 1; i < f.consecutive && delay < eb.max; i++ {
+		delay *= 2
+	}
+	if delay > eb.max {
+		delay = eb.max
+	}
+
+	f.retryAt = now.Add(delay)
+	return f.consecutive, f.retryAt
+}
+
+// success resets the failures of the entity cleanup in the given project.
+func (eb *entityBackoff) success(entity, projectID string) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	delete(eb.failures, eb.key(entity, projectID))
+}
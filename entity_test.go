@@ -0,0 +1,43 @@
+package gcloudcleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntityBackoff(t *testing.T) {
+	eb := newEntityBackoff(time.Minute, 5*time.Minute)
+	now := time.Now()
+
+	ready, _ := eb.ready("instances", "foo-project", now)
+	assert.True(t, ready)
+
+	for i, expected := range []time.Duration{
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute,
+	} {
+		failures, retryAt := eb.failure("instances", "foo-project", now)
+		assert.Equal(t, i+1, failures)
+		assert.Equal(t, now.Add(expected), retryAt)
+	}
+
+	ready, retryAt := eb.ready("instances", "foo-project", now.Add(time.Minute))
+	assert.False(t, ready)
+	assert.Equal(t, now.Add(5*time.Minute), retryAt)
+
+	ready, _ = eb.ready("instances", "foo-project", now.Add(5*time.Minute))
+	assert.True(t, ready)
+
+	ready, _ = eb.ready("images", "foo-project", now)
+	assert.True(t, ready)
+	ready, _ = eb.ready("instances", "bar-project", now)
+	assert.True(t, ready)
+
+	eb.success("instances", "foo-project")
+	ready, _ = eb.ready("instances", "foo-project", now)
+	assert.True(t, ready)
+
+	failures, _ := eb.failure("instances", "foo-project", now)
+	assert.Equal(t, 1, failures)
+}
@@ -8,34 +8,109 @@ import (
 
 var (
 	Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "path to a YAML or JSON policy file defining cleanup rules per entity, reloaded on SIGHUP",
+			EnvVars: []string{"GCLOUD_CLEANUP_CONFIG"},
+		},
 		&cli.StringFlag{
 			Name:    "account-json",
 			Value:   "",
 			Usage:   "file path to or json blob of GCE account stuff",
 			EnvVars: []string{"GCLOUD_CLEANUP_ACCOUNT_JSON", "GOOGLE_CREDENTIALS"},
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:    "project-id",
-			Value:   "",
-			Usage:   "name of GCE project",
+			Usage:   "name of GCE project, may be given multiple times",
 			EnvVars: []string{"GCLOUD_CLEANUP_PROJECT_ID", "GCLOUD_PROJECT"},
 		},
+		&cli.StringFlag{
+			Name:    "project-label-selector",
+			Usage:   "resource manager filter selecting additional projects to clean up, e.g. labels.gcloud-cleanup:true",
+			EnvVars: []string{"GCLOUD_CLEANUP_PROJECT_LABEL_SELECTOR"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "project-filters",
+			Usage:   "per-project filters overriding the entity filters, as <project>/<entity>=<filter>",
+			EnvVars: []string{"GCLOUD_CLEANUP_PROJECT_FILTERS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "project-rate-limit-prefixes",
+			Usage:   "per-project prefixes for the rate limit key in Redis, as <project>=<prefix>",
+			EnvVars: []string{"GCLOUD_CLEANUP_PROJECT_RATE_LIMIT_PREFIXES"},
+		},
 		&cli.DurationFlag{
 			Name:    "instance-max-age",
 			Value:   3 * time.Hour,
 			Usage:   "max age for an instance to be considered deletable",
 			EnvVars: []string{"GCLOUD_CLEANUP_INSTANCE_MAX_AGE"},
 		},
+		&cli.StringFlag{
+			Name:    "instance-ttl-label",
+			Value:   "ttl",
+			Usage:   "instance label holding a duration overriding the max age for that instance",
+			EnvVars: []string{"GCLOUD_CLEANUP_INSTANCE_TTL_LABEL"},
+		},
+		&cli.StringFlag{
+			Name:    "instance-expires-at-label",
+			Value:   "expires-at",
+			Usage:   "instance label holding a unix timestamp after which that instance is deletable",
+			EnvVars: []string{"GCLOUD_CLEANUP_INSTANCE_EXPIRES_AT_LABEL"},
+		},
 		&cli.StringSliceFlag{
 			Name:    "instance-filters",
 			Usage:   "filters used when fetching instances for deletion",
 			EnvVars: []string{"GCLOUD_CLEANUP_INSTANCE_FILTERS"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "zones",
+			Usage:   "zones to clean up instances in, instead of all zones",
+			EnvVars: []string{"GCLOUD_CLEANUP_ZONES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "regions",
+			Usage:   "regions whose zones to clean up instances in, instead of all zones",
+			EnvVars: []string{"GCLOUD_CLEANUP_REGIONS"},
+		},
 		&cli.StringSliceFlag{
 			Name:    "image-filters",
 			Usage:   "filters used when fetching images for deletion",
 			EnvVars: []string{"GCLOUD_CLEANUP_IMAGE_FILTERS"},
 		},
+		&cli.DurationFlag{
+			Name:    "disk-max-age",
+			Value:   3 * time.Hour,
+			Usage:   "max age for an unattached disk to be considered deletable",
+			EnvVars: []string{"GCLOUD_CLEANUP_DISK_MAX_AGE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "disk-filters",
+			Usage:   "filters used when fetching disks for deletion",
+			EnvVars: []string{"GCLOUD_CLEANUP_DISK_FILTERS"},
+		},
+		&cli.DurationFlag{
+			Name:    "snapshot-max-age",
+			Value:   30 * 24 * time.Hour,
+			Usage:   "max age for a snapshot to be considered deletable",
+			EnvVars: []string{"GCLOUD_CLEANUP_SNAPSHOT_MAX_AGE"},
+		},
+		&cli.IntFlag{
+			Name:    "snapshot-keep-last",
+			Value:   3,
+			Usage:   "number of most recent snapshots per source disk to keep regardless of age",
+			EnvVars: []string{"GCLOUD_CLEANUP_SNAPSHOT_KEEP_LAST"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "snapshot-filters",
+			Usage:   "filters used when fetching snapshots for deletion",
+			EnvVars: []string{"GCLOUD_CLEANUP_SNAPSHOT_FILTERS"},
+		},
+		&cli.StringFlag{
+			Name:    "protection-label",
+			Value:   "gcloud-cleanup-protect=true",
+			Usage:   "label (key=value or key) marking instances and images that must never be cleaned up",
+			EnvVars: []string{"GCLOUD_CLEANUP_PROTECTION_LABEL"},
+		},
 		&cli.StringSliceFlag{
 			Name:    "entities",
 			Usage:   "entities to clean up",
@@ -44,7 +119,7 @@ var (
 		&cli.DurationFlag{
 			Name:    "loop-sleep",
 			Value:   5 * time.Minute,
-			Usage:   "sleep time between loops",
+			Usage:   "interval between runs of entities without a schedule, and between resolving projects",
 			EnvVars: []string{"GCLOUD_CLEANUP_LOOP_SLEEP"},
 		},
 		&cli.BoolFlag{
@@ -54,14 +129,84 @@ var (
 		},
 		&cli.StringFlag{
 			Name:    "rate-limit-redis-url",
-			Usage:   "URL to Redis instance to use for rate limiting",
+			Usage:   "URL to Redis instance to use for rate limiting across processes, limiting in-process if empty (Redis Cluster is not supported)",
 			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_URL"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "rate-limit-redis-sentinel-addrs",
+			Usage:   "addresses of Redis Sentinels to ask for the address of the master, replacing the host of the Redis URL",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_SENTINEL_ADDRS"},
+		},
+		&cli.StringFlag{
+			Name:    "rate-limit-redis-sentinel-master",
+			Usage:   "name of the master to ask the Redis Sentinels for",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_SENTINEL_MASTER"},
+		},
+		&cli.StringFlag{
+			Name:    "rate-limit-redis-tls-ca-file",
+			Usage:   "PEM file with the CAs to verify the Redis server certificate with for rediss:// URLs, using the system CAs if empty",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_TLS_CA_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "rate-limit-redis-tls-skip-verify",
+			Usage:   "don't verify the Redis server certificate, for local testing only",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_TLS_SKIP_VERIFY"},
+		},
+		&cli.IntFlag{
+			Name:    "rate-limit-redis-pool-max-active",
+			Value:   10,
+			Usage:   "max number of connections to Redis open at once",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_POOL_MAX_ACTIVE"},
+		},
+		&cli.IntFlag{
+			Name:    "rate-limit-redis-pool-max-idle",
+			Value:   5,
+			Usage:   "max number of idle connections to Redis kept open",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_POOL_MAX_IDLE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "entity-schedules",
+			Usage:   "per-entity schedules as <entity>=<interval or cron expression>, e.g. images=1h or \"snapshots=0 3 * * *\", defaulting to loop-sleep",
+			EnvVars: []string{"GCLOUD_CLEANUP_ENTITY_SCHEDULES"},
+		},
+		&cli.DurationFlag{
+			Name:    "schedule-jitter",
+			Usage:   "max random delay added to every scheduled run",
+			EnvVars: []string{"GCLOUD_CLEANUP_SCHEDULE_JITTER"},
+		},
+		&cli.BoolFlag{
+			Name:    "leader-election",
+			Usage:   "only clean up while holding a lease in the rate limit Redis, so that one replica cleans up at a time",
+			EnvVars: []string{"GCLOUD_CLEANUP_LEADER_ELECTION"},
+		},
+		&cli.StringFlag{
+			Name:    "leader-lease-key",
+			Value:   "gcloud-cleanup:leader",
+			Usage:   "Redis key of the leader lease",
+			EnvVars: []string{"GCLOUD_CLEANUP_LEADER_LEASE_KEY"},
+		},
+		&cli.DurationFlag{
+			Name:    "leader-lease-ttl",
+			Value:   1 * time.Minute,
+			Usage:   "time after which the leader lease expires unless renewed, at least 1s",
+			EnvVars: []string{"GCLOUD_CLEANUP_LEADER_LEASE_TTL"},
+		},
+		&cli.StringFlag{
+			Name:    "leader-id",
+			Usage:   "id of this replica for leader election, defaulting to <hostname>-<pid>",
+			EnvVars: []string{"GCLOUD_CLEANUP_LEADER_ID"},
+		},
 		&cli.StringFlag{
 			Name:    "rate-limit-prefix",
 			Usage:   "prefix for the rate limit key in Redis",
 			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_PREFIX"},
 		},
+		&cli.StringFlag{
+			Name:    "rate-limit-algorithm",
+			Value:   "watch",
+			Usage:   "Redis rate limiting algorithm, either \"watch\", \"fixed-window\", \"sliding-window\" or \"gcra\"",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_ALGORITHM"},
+		},
 		&cli.IntFlag{
 			Name:    "rate-limit-max-calls",
 			Value:   10,
@@ -71,9 +216,68 @@ var (
 		&cli.DurationFlag{
 			Name:    "rate-limit-duration",
 			Value:   1 * time.Second,
-			Usage:   "interval in which to let max-calls through to the GCE API",
+			Usage:   "interval in which to let max-calls through to the GCE API, at least 1s for the watch algorithm and 1ms otherwise",
 			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_DURATION"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "rate-limits",
+			Usage:   "per-bucket rate limits as <bucket>=<max-calls>/<duration>, where bucket is \"list\", \"delete\", \"serial-output\" or \"operations\", defaulting to max-calls per duration",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMITS"},
+		},
+		&cli.Float64Flag{
+			Name:    "rate-limit-min-factor",
+			Value:   0.1,
+			Usage:   "lowest fraction of max-calls to let through after GCE quota errors, 1 to never slow down",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_MIN_FACTOR"},
+		},
+		&cli.DurationFlag{
+			Name:    "rate-limit-recovery",
+			Value:   10 * time.Minute,
+			Usage:   "time to recover from the min factor to the full rate without further GCE quota errors",
+			EnvVars: []string{"GCLOUD_CLEANUP_RATE_LIMIT_RECOVERY"},
+		},
+		&cli.DurationFlag{
+			Name:    "entity-backoff",
+			Value:   time.Minute,
+			Usage:   "delay before retrying a failed entity cleanup, doubled on each consecutive failure",
+			EnvVars: []string{"GCLOUD_CLEANUP_ENTITY_BACKOFF"},
+		},
+		&cli.DurationFlag{
+			Name:    "entity-max-backoff",
+			Value:   30 * time.Minute,
+			Usage:   "maximum delay before retrying a failed entity cleanup",
+			EnvVars: []string{"GCLOUD_CLEANUP_ENTITY_MAX_BACKOFF"},
+		},
+		&cli.IntFlag{
+			Name:    "entity-max-failures",
+			Value:   10,
+			Usage:   "exit after this many consecutive failures of an entity cleanup in a project (0 to never exit)",
+			EnvVars: []string{"GCLOUD_CLEANUP_ENTITY_MAX_FAILURES"},
+		},
+		&cli.DurationFlag{
+			Name:    "list-retry-budget",
+			Value:   2 * time.Minute,
+			Usage:   "how long failing list calls are retried before the cleanup run is aborted",
+			EnvVars: []string{"GCLOUD_CLEANUP_LIST_RETRY_BUDGET"},
+		},
+		&cli.DurationFlag{
+			Name:    "shutdown-grace-period",
+			Value:   30 * time.Second,
+			Usage:   "how long in-flight cleanups may keep running after SIGTERM or SIGINT",
+			EnvVars: []string{"GCLOUD_CLEANUP_SHUTDOWN_GRACE_PERIOD"},
+		},
+		&cli.DurationFlag{
+			Name:    "operation-timeout",
+			Value:   2 * time.Minute,
+			Usage:   "max time to wait for a delete operation to finish",
+			EnvVars: []string{"GCLOUD_CLEANUP_OPERATION_TIMEOUT"},
+		},
+		&cli.IntFlag{
+			Name:    "delete-concurrency",
+			Value:   1,
+			Usage:   "number of deletions to process in parallel per entity",
+			EnvVars: []string{"GCLOUD_CLEANUP_DELETE_CONCURRENCY"},
+		},
 		&cli.StringFlag{
 			Name:    "job-board-url",
 			Value:   "http://localhost:4567",
@@ -118,6 +322,38 @@ var (
 			Usage:   "don't do mutative stuff",
 			EnvVars: []string{"GCLOUD_CLEANUP_NOOP", "NOOP"},
 		},
+		&cli.BoolFlag{
+			Name:    "plan",
+			Usage:   "run once and report what would be cleaned up instead of cleaning up, the same as the plan command",
+			EnvVars: []string{"GCLOUD_CLEANUP_PLAN"},
+		},
+		&cli.StringFlag{
+			Name:    "plan-format",
+			Value:   "table",
+			Usage:   "format of the plan report, either \"table\" or \"json\"",
+			EnvVars: []string{"GCLOUD_CLEANUP_PLAN_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "plan-output",
+			Usage:   "file to write the plan report to, defaults to stdout",
+			EnvVars: []string{"GCLOUD_CLEANUP_PLAN_OUTPUT"},
+		},
+		&cli.StringFlag{
+			Name:    "prometheus-addr",
+			Usage:   "address to serve Prometheus metrics on at /metrics, e.g. :9090, disabled if empty",
+			EnvVars: []string{"GCLOUD_CLEANUP_PROMETHEUS_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "status-addr",
+			Usage:   "address to serve /healthz, /readyz and /status on, e.g. :8080, disabled if empty",
+			EnvVars: []string{"GCLOUD_CLEANUP_STATUS_ADDR"},
+		},
+		&cli.DurationFlag{
+			Name:    "health-stall-timeout",
+			Value:   30 * time.Minute,
+			Usage:   "report unhealthy on /healthz once the cleanup loop made no progress for this long",
+			EnvVars: []string{"GCLOUD_CLEANUP_HEALTH_STALL_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "librato-email",
 			Usage:   "librato account for collecting metrics",
@@ -15,6 +15,7 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 )
@@ -24,12 +25,15 @@ type gceAccountJSON struct {
 	PrivateKey  string `json:"private_key"`
 }
 
-func buildGoogleComputeService(accountJSON string) (*compute.Service, error) {
+// buildGoogleComputeService builds a compute service, calling onQuotaError
+// (if not nil) with the project of every call failing with a quota error.
+func buildGoogleComputeService(accountJSON string, onQuotaError func(projectID, bucket string)) (*compute.Service, error) {
 	if accountJSON == "" {
 		client, err := google.DefaultClient(context.TODO(), compute.DevstorageFullControlScope, compute.ComputeScope)
 		if err != nil {
 			return nil, errors.Wrap(err, "could not build default client")
 		}
+		withQuotaErrorTransport(client, onQuotaError)
 		return compute.New(client)
 	}
 
@@ -53,6 +57,7 @@ func buildGoogleComputeService(accountJSON string) (*compute.Service, error) {
 	})
 
 	client := config.Client(ctx)
+	withQuotaErrorTransport(client, onQuotaError)
 
 	cs, err := compute.New(client)
 	if err != nil {
@@ -64,6 +69,59 @@ func buildGoogleComputeService(accountJSON string) (*compute.Service, error) {
 	return cs, nil
 }
 
+func withQuotaErrorTransport(client *http.Client, onQuotaError func(projectID, bucket string)) {
+	if onQuotaError == nil {
+		return
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	client.Transport = &quotaErrorTransport{
+		base:         base,
+		onQuotaError: onQuotaError,
+	}
+}
+
+func buildGoogleResourceManagerService(accountJSON string) (*cloudresourcemanager.Service, error) {
+	if accountJSON == "" {
+		client, err := google.DefaultClient(context.TODO(), cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not build default client")
+		}
+		return cloudresourcemanager.New(client)
+	}
+
+	a, err := loadGoogleAccountJSON(accountJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	config := jwt.Config{
+		Email:      a.ClientEmail,
+		PrivateKey: []byte(a.PrivateKey),
+		Scopes: []string{
+			cloudresourcemanager.CloudPlatformReadOnlyScope,
+		},
+		TokenURL: "https://accounts.google.com/o/oauth2/token",
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: &ochttp.Transport{},
+	})
+
+	rms, err := cloudresourcemanager.New(config.Client(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	rms.UserAgent = "gcloud-cleanup"
+
+	return rms, nil
+}
+
 func buildGoogleStorageClient(ctx context.Context, accountJSON string) (*storage.Client, error) {
 	if accountJSON == "" {
 		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadWrite)
@@ -1,9 +1,12 @@
 module github.com/travis-ci/gcloud-cleanup
 
+go 1.27.1
+
 require (
 	cloud.google.com/go v0.28.0
 	contrib.go.opencensus.io/exporter/stackdriver v0.0.0-20180910204836-9f333b48d382
 	github.com/Shopify/sarama v0.0.0-20180615224312-46cf3e2cf1ac
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/apache/thrift v0.0.0-20180622210517-af7ecd6a2b15
 	github.com/aws/aws-sdk-go v1.15.31
 	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973
@@ -31,6 +34,7 @@ require (
 	github.com/prometheus/common v0.0.0-20180801064454-c7de2306084e
 	github.com/prometheus/procfs v0.0.0-20180725123919-05ee40e3a273
 	github.com/rcrowley/go-metrics v0.0.0-20180503174638-e2704e165165
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v0.0.0-20180625052543-e3292c4c4d7f
 	github.com/stretchr/testify v1.2.2
 	go.opencensus.io v0.15.0
@@ -40,7 +44,7 @@ require (
 	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd
 	golang.org/x/oauth2 v0.0.0-20180620175406-ef147856a6dd
 	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f
-	golang.org/x/sys v0.0.0-20180909124046-d0be0721c37e
+	golang.org/x/sys v0.0.0-20190204203706-41f3e6584952
 	golang.org/x/text v0.3.0
 	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2
 	google.golang.org/api v0.0.0-20180916000451-19ff8768a5c0
@@ -51,4 +55,13 @@ require (
 	gopkg.in/airbrake/gobrake.v2 v2.0.9
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2
 	gopkg.in/urfave/cli.v2 v2.0.0-20180128182452-d3ae77c26ac8
+	gopkg.in/yaml.v2 v2.2.1
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/go-ini/ini v1.25.4 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
 )
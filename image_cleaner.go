@@ -1,15 +1,18 @@
 package gcloudcleanup
 
 import (
-	"math/rand"
+	"context"
+	"fmt"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/api/compute/v1"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/travis-ci/gcloud-cleanup/metrics"
+	travismetrics "github.com/travis-ci/gcloud-cleanup/metrics"
 	"github.com/travis-ci/gcloud-cleanup/ratelimit"
 )
 
@@ -23,25 +26,50 @@ type imageCleaner struct {
 
 	noop bool
 
-	rateLimiter       ratelimit.RateLimiter
-	rateLimitMaxCalls uint64
-	rateLimitDuration time.Duration
+	protectionLabel protectionLabel
+
+	policies *policyStore
+
+	// plan collects the images that would be deleted instead of deleting
+	// them
+	plan *plan
+
+	operationTimeout  time.Duration
+	deleteConcurrency int
+
+	// listRetryBudget is how long failing list calls are retried before
+	// giving up on the run
+	listRetryBudget time.Duration
+
+	// shutdownGracePeriod is how long in-flight deletions may keep running
+	// once the context passed to Run is done
+	shutdownGracePeriod time.Duration
+
+	rateLimiter ratelimit.RateLimiter
+	rateLimits  rateLimits
+
+	// lastCounts holds the counts of the last run
+	lastCounts map[string]int64
 }
 
 type imageDeletionRequest struct {
 	Image  *compute.Image
 	Reason string
+	Rule   string
 }
 
 func newImageCleaner(
 	cs *compute.Service,
-	log *logrus.Logger,
+	log *logrus.Entry,
 	rateLimiter ratelimit.RateLimiter,
-	rateLimitMaxCalls uint64,
-	rateLimitDuration time.Duration,
+	rateLimits rateLimits,
+	operationTimeout time.Duration,
+	deleteConcurrency int,
 	projectID,
 	jobBoardURL string,
 	filters []string,
+	protectionLabel protectionLabel,
+	policies *policyStore,
 	noop bool,
 ) *imageCleaner {
 	return &imageCleaner{
@@ -54,19 +82,25 @@ func newImageCleaner(
 
 		noop: noop,
 
-		rateLimiter:       rateLimiter,
-		rateLimitMaxCalls: rateLimitMaxCalls,
-		rateLimitDuration: rateLimitDuration,
+		protectionLabel: protectionLabel,
+
+		policies: policies,
+
+		operationTimeout:  operationTimeout,
+		deleteConcurrency: deleteConcurrency,
+
+		rateLimiter: rateLimiter,
+		rateLimits:  rateLimits,
 	}
 }
 
-func (ic *imageCleaner) Run() error {
+func (ic *imageCleaner) Run(ctx context.Context) error {
 	ic.log.WithFields(logrus.Fields{
 		"project": ic.projectID,
 		"filters": strings.Join(ic.filters, ","),
 	}).Info("running image cleanup")
 
-	registeredImages, err := ic.fetchRegisteredImages()
+	registeredImages, err := ic.fetchRegisteredImages(ctx)
 	if err != nil {
 		return err
 	}
@@ -81,51 +115,82 @@ func (ic *imageCleaner) Run() error {
 	imgChan := make(chan *imageDeletionRequest)
 	errChan := make(chan error)
 
-	go ic.fetchImagesToDelete(registeredImages, imgChan, errChan)
-	go func() {
-		for err := range errChan {
-			if err == nil {
+	go ic.fetchImagesToDelete(ctx, registeredImages, imgChan, errChan)
+	fetchErrChan := collectFetchErrors(ic.log, "error during image fetch", errChan)
+
+	nDeleted := int64(0)
+	nFailed := int64(0)
+	nSkipped := int64(0)
+
+	workCtx, cancel := withGracePeriod(ctx, ic.shutdownGracePeriod)
+	defer cancel()
+
+	runWorkers(workCtx, ic.deleteConcurrency, "ImageDeleteWorker", func(workCtx context.Context, worker int) {
+		for req := range imgChan {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&nSkipped, 1)
 				continue
 			}
-			ic.log.WithField("err", err).Warn("error during image fetch")
-		}
-	}()
 
-	nDeleted := 0
+			if ic.plan != nil {
+				ic.plan.add(ic.projectID, "images", req.Image.Name, "",
+					req.Image.CreationTimestamp, req.Reason, req.Rule, policyActionDelete,
+					req.Image.Labels, time.Now().UTC())
+				continue
+			}
 
-	for req := range imgChan {
-		if req == nil {
-			break
-		}
+			err := ic.deleteImage(workCtx, req.Image)
 
-		if ic.noop {
-			ic.log.WithField("image", req.Image.Name).Debug("not really deleting image")
-			continue
-		}
+			if err != nil {
+				atomic.AddInt64(&nFailed, 1)
+				travismetrics.ResourceFailed(ic.projectID, "images", "deleted", "")
+
+				ic.log.WithFields(logrus.Fields{
+					"err":    err,
+					"image":  req.Image.Name,
+					"worker": worker,
+				}).Warn("failed to delete image")
+				continue
+			}
 
-		err := ic.deleteImage(req.Image)
+			atomic.AddInt64(&nDeleted, 1)
+			travismetrics.ResourceCleaned(ic.projectID, "images", "deleted", req.Reason, "")
 
-		if err != nil {
 			ic.log.WithFields(logrus.Fields{
-				"err":   err,
-				"image": req.Image.Name,
-			}).Warn("failed to delete image")
+				"image":  req.Image.Name,
+				"reason": req.Reason,
+				"rule":   req.Rule,
+				"worker": worker,
+			}).Info("deleted")
 		}
+	})
+
+	ic.lastCounts = map[string]int64{
+		"deleted": nDeleted,
+		"failed":  nFailed,
+		"skipped": nSkipped,
+	}
 
-		nDeleted++
+	// the global images.deleted metric has always been a gauge
+	travismetrics.Gauge("travis.gcloud-cleanup.images.deleted", nDeleted)
+	travismetrics.Counter(fmt.Sprintf("travis.gcloud-cleanup.projects.%s.images.deleted", ic.projectID), nDeleted)
+	projectCounter(ic.projectID, "images.failed", nFailed)
+	ic.l2met("measure#images.failed", int(nFailed), "counted failed image deletions")
+	ic.l2met("measure#images.deleted", int(nDeleted), "done running image cleanup")
 
-		ic.log.WithFields(logrus.Fields{
-			"image":  req.Image.Name,
-			"reason": req.Reason,
-		}).Info("deleted")
+	if nSkipped > 0 {
+		ic.log.WithField("skipped", nSkipped).Warn("skipped images due to shutdown")
 	}
 
-	metrics.Gauge("travis.gcloud-cleanup.images.deleted", int64(nDeleted))
-	ic.l2met("measure#images.deleted", nDeleted, "done running image cleanup")
-	return nil
+	fetchErr := <-fetchErrChan
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	return ctx.Err()
 }
 
-func (ic *imageCleaner) fetchRegisteredImages() (map[string]bool, error) {
+func (ic *imageCleaner) fetchRegisteredImages(ctx context.Context) (map[string]bool, error) {
 	images := map[string]bool{}
 	nameFilter := ""
 
@@ -148,14 +213,14 @@ func (ic *imageCleaner) fetchRegisteredImages() (map[string]bool, error) {
 	qs.Set("name", nameFilter)
 
 	u, err := url.Parse(ic.jobBoardURL)
-	u.Path = "/images"
-	u.RawQuery = qs.Encode()
-
 	if err != nil {
 		return images, err
 	}
 
-	imageResp, err := makeJobBoardImagesRequest(u.String())
+	u.Path = "/images"
+	u.RawQuery = qs.Encode()
+
+	imageResp, err := makeJobBoardImagesRequest(ctx, u.String())
 	if err != nil {
 		return images, err
 	}
@@ -171,9 +236,12 @@ func (ic *imageCleaner) fetchRegisteredImages() (map[string]bool, error) {
 	return images, nil
 }
 
-func (ic *imageCleaner) fetchImagesToDelete(registeredImages map[string]bool,
+func (ic *imageCleaner) fetchImagesToDelete(ctx context.Context, registeredImages map[string]bool,
 	imgChan chan *imageDeletionRequest, errChan chan error) {
 
+	defer close(errChan)
+	defer close(imgChan)
+
 	listCall := ic.cs.Images.List(ic.projectID)
 	for _, filter := range ic.filters {
 		listCall.Filter(filter)
@@ -181,28 +249,58 @@ func (ic *imageCleaner) fetchImagesToDelete(registeredImages map[string]bool,
 
 	pageTok := ""
 	nImages := 0
+	nProtected := 0
 
 	for {
+		if ctx.Err() != nil {
+			return
+		}
+
 		if pageTok != "" {
 			listCall.PageToken(pageTok)
 		}
 
-		ic.apiRateLimit()
 		ic.log.WithField("page_token", pageTok).Debug("fetching images list")
-		resp, err := listCall.Do()
+
+		var resp *compute.ImageList
+		err := retryListCall(ctx, ic.log, ic.listRetryBudget, func() (err error) {
+			if err = ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+				return
+			}
+			resp, err = listCall.Context(ctx).Do()
+			return
+		})
 
 		if err != nil {
-			errChan <- err
-			continue
+			errChan <- errors.Wrap(err, "could not list images")
+			return
 		}
 
 		for _, image := range resp.Items {
 			nImages++
 
-			if _, ok := registeredImages[image.Name]; !ok {
-				ic.log.WithField("image", image.Name).Debug("sending image for deletion")
+			if ic.protectionLabel.matches(image.Labels) {
+				nProtected++
+
+				ic.log.WithFields(logrus.Fields{
+					"image":            image.Name,
+					"protection_label": ic.protectionLabel.String(),
+				}).Info("skipping protected image")
+				continue
+			}
 
-				imgChan <- &imageDeletionRequest{Image: image, Reason: "not-registered"}
+			rule := ic.matchingRule(image, registeredImages, time.Now().UTC())
+			if rule != nil {
+				ic.log.WithFields(logrus.Fields{
+					"image": image.Name,
+					"rule":  rule.Name,
+				}).Debug("sending image for deletion")
+
+				select {
+				case imgChan <- &imageDeletionRequest{Image: image, Reason: rule.reason(), Rule: rule.Name}:
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
 
@@ -218,41 +316,101 @@ func (ic *imageCleaner) fetchImagesToDelete(registeredImages map[string]bool,
 		pageTok = resp.NextPageToken
 	}
 
+	projectCounter(ic.projectID, "images.protected", int64(nProtected))
+	ic.l2met("gauge#images.protected", nProtected, "counted protected images")
 	ic.l2met("gauge#images.count", nImages, "done checking all images")
-	imgChan <- nil
-	errChan <- nil
 }
 
-func (ic *imageCleaner) deleteImage(image *compute.Image) error {
-	ic.apiRateLimit()
-	_, err := ic.cs.Images.Delete(ic.projectID, image.Name).Do()
-	return err
-}
+// matchingRule returns the first rule matching the image, if any.
+func (ic *imageCleaner) matchingRule(image *compute.Image, registeredImages map[string]bool, now time.Time) *policyRule {
+	for _, rule := range ic.rules() {
+		if rule.Unregistered && registeredImages[image.Name] {
+			continue
+		}
 
-func (ic *imageCleaner) l2met(name string, n int, msg string) {
-	ic.log.WithField(name, n).Info(msg)
-}
+		if !rule.matches(image.Name, image.Status, image.Labels) {
+			continue
+		}
 
-func (ic *imageCleaner) apiRateLimit() error {
-	ic.log.Debug("waiting for rate limiter tick")
-	errCount := 0
+		if rule.maxAge > 0 {
+			ts, err := time.Parse(time.RFC3339, image.CreationTimestamp)
+			if err != nil {
+				ic.log.WithFields(logrus.Fields{
+					"err":   err,
+					"image": image.Name,
+				}).Warn("failed to parse creation timestamp")
+				return nil
+			}
 
-	for {
-		ok, err := ic.rateLimiter.RateLimit("gce-api", ic.rateLimitMaxCalls, ic.rateLimitDuration)
-		if err != nil {
-			errCount++
-			if errCount >= 5 {
-				ic.log.WithField("err", err).Info("rate limiter errored 5 times")
-				return err
+			if !ts.Before(now.Add(-1 * rule.maxAge)) {
+				continue
 			}
-		} else {
-			errCount = 0
 		}
-		if ok {
-			return nil
+
+		return rule
+	}
+
+	return nil
+}
+
+// rules returns the image rules of the current policy, or the default rules
+// if there is no policy.
+func (ic *imageCleaner) rules() []*policyRule {
+	if ic.policies != nil {
+		return ic.policies.imageRules()
+	}
+	return defaultImageRules()
+}
+
+// getImage looks up an image by name.
+func (ic *imageCleaner) getImage(ctx context.Context, name string) (*compute.Image, error) {
+	var image *compute.Image
+	err := retryListCall(ctx, ic.log, ic.listRetryBudget, func() (err error) {
+		if err = ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+			return
 		}
+		image, err = ic.cs.Images.Get(ic.projectID, name).Context(ctx).Do()
+		return
+	})
+	if isNotFoundError(err) {
+		return nil, errors.Wrapf(errResourceNotFound, "image %s", name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get image")
+	}
+	return image, nil
+}
 
-		// Sleep for up to 1 second
-		time.Sleep(time.Millisecond * time.Duration(rand.Intn(1000)))
+func (ic *imageCleaner) deleteImage(ctx context.Context, image *compute.Image) error {
+	if ic.noop {
+		ic.log.WithField("image", image.Name).Debug("not really deleting image")
+		return nil
+	}
+
+	if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketDelete); err != nil {
+		return err
+	}
+	op, err := ic.cs.Images.Delete(ic.projectID, image.Name).Context(ctx).Do()
+	if err != nil {
+		return err
 	}
+
+	op, err = waitForOperation(ctx, op, ic.operationTimeout, func(ctx context.Context, name string) (*compute.Operation, error) {
+		if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketOperations); err != nil {
+			return nil, err
+		}
+		return ic.cs.GlobalOperations.Get(ic.projectID, name).Context(ctx).Do()
+	})
+
+	ic.log.WithFields(logrus.Fields{
+		"image":     image.Name,
+		"operation": op.Name,
+		"status":    op.Status,
+	}).Debug("finished waiting for delete operation")
+
+	return err
+}
+
+func (ic *imageCleaner) l2met(name string, n int, msg string) {
+	ic.log.WithField(name, n).Info(msg)
 }
@@ -1,6 +1,7 @@
 package gcloudcleanup
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 
 	compute "google.golang.org/api/compute/v1"
 
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/travis-ci/gcloud-cleanup/ratelimit"
@@ -20,9 +22,9 @@ func TestNewImageCleaner(t *testing.T) {
 	log := logrus.New()
 	ratelimit := ratelimit.NewNullRateLimiter()
 
-	ic := newImageCleaner(nil, log, ratelimit, 10, time.Second,
+	ic := newImageCleaner(nil, log.WithField("test", "yep"), ratelimit, defaultRateLimits(10, time.Second), time.Minute, 2,
 		"foo-project", "http://foo.example.com",
-		[]string{"name eq ^travis-test.*"}, true)
+		[]string{"name eq ^travis-test.*"}, protectionLabel{}, nil, true)
 
 	assert.NotNil(t, ic)
 	assert.Nil(t, ic.cs)
@@ -43,6 +45,13 @@ func TestImageCleaner_Run(t *testing.T) {
 						"name":   "travis-test-image-0",
 						"status": "READY",
 					},
+					map[string]interface{}{
+						"name":   "travis-test-image-1",
+						"status": "READY",
+						"labels": map[string]string{
+							"gcloud-cleanup-protect": "true",
+						},
+					},
 					map[string]string{
 						"name":   "travis-test-bananapants-9001",
 						"status": "READY",
@@ -59,7 +68,7 @@ func TestImageCleaner_Run(t *testing.T) {
 	gceMux.HandleFunc("/foo-project/global/images/travis-test-image-0",
 		func(w http.ResponseWriter, req *http.Request) {
 			assert.Equal(t, req.Method, "DELETE")
-			fmt.Fprintf(w, `{}`)
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
 		})
 	gceMux.HandleFunc("/",
 		func(w http.ResponseWriter, req *http.Request) {
@@ -107,10 +116,90 @@ func TestImageCleaner_Run(t *testing.T) {
 	}
 	rl := ratelimit.NewNullRateLimiter()
 
-	ic := newImageCleaner(cs, log, rl, 10, time.Second,
+	ic := newImageCleaner(cs, log.WithField("test", "yep"), rl, defaultRateLimits(10, time.Second), time.Minute, 2,
 		"foo-project", jbSrv.URL,
-		[]string{"name eq ^travis-test.*"}, false)
+		[]string{"name eq ^travis-test.*"},
+		parseProtectionLabel("gcloud-cleanup-protect=true"), nil, false)
+
+	deletedCounter := gometrics.GetOrRegisterCounter("travis.gcloud-cleanup.projects.foo-project.images.deleted", gometrics.DefaultRegistry)
+	deletedBefore := deletedCounter.Count()
 
-	err = ic.Run()
+	err = ic.Run(context.Background())
 	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deletedCounter.Count()-deletedBefore)
+
+	// deletions add up across runs rather than being overwritten
+	err = ic.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deletedCounter.Count()-deletedBefore)
+
+	// the global metric is still the gauge of the last run
+	deletedGauge, ok := gometrics.DefaultRegistry.Get("travis.gcloud-cleanup.images.deleted").(gometrics.Gauge)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), deletedGauge.Value())
+}
+
+func TestImageCleaner_fetchRegisteredImages(t *testing.T) {
+	ic := &imageCleaner{log: logrus.New().WithField("test", "yep")}
+
+	ic.jobBoardURL = "http://foo.example.com/%zz"
+	_, err := ic.fetchRegisteredImages(context.Background())
+	assert.NotNil(t, err)
+
+	requested := make(chan struct{})
+	jbSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(requested)
+		<-req.Context().Done()
+	}))
+	defer jbSrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+
+	ic.jobBoardURL = jbSrv.URL
+	_, err = ic.fetchRegisteredImages(ctx)
+	assert.Contains(t, fmt.Sprintf("%v", err), context.Canceled.Error())
+}
+
+func TestImageCleaner_Run_listError(t *testing.T) {
+	calls := 0
+
+	gceMux := http.NewServeMux()
+	gceMux.HandleFunc(
+		"/foo-project/global/images",
+		func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error": {"code": 404, "message": "project not found"}}`)
+		})
+
+	gceSrv := httptest.NewServer(gceMux)
+	defer gceSrv.Close()
+
+	jbMux := http.NewServeMux()
+	jbMux.HandleFunc("/images", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"data": [{"name": "travis-test-bananapants-9000"}]}`)
+	})
+
+	jbSrv := httptest.NewServer(jbMux)
+	defer jbSrv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = gceSrv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	ic := newImageCleaner(cs, log.WithField("test", "yep"), ratelimit.NewNullRateLimiter(), defaultRateLimits(10, time.Second), time.Minute, 2,
+		"foo-project", jbSrv.URL,
+		[]string{"name eq ^travis-test.*"}, protectionLabel{}, nil, false)
+	ic.listRetryBudget = time.Second
+
+	err = ic.Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
 }
@@ -6,15 +6,20 @@ import (
 	"io"
 	"math/rand"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"go.opencensus.io/trace"
 	"google.golang.org/api/compute/v1"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/travis-ci/gcloud-cleanup/metrics"
+	travismetrics "github.com/travis-ci/gcloud-cleanup/metrics"
 	"github.com/travis-ci/gcloud-cleanup/ratelimit"
 )
 
@@ -23,36 +28,64 @@ var (
 )
 
 type instanceCleaner struct {
-	ctx context.Context
 	cs  *compute.Service
 	sc  *storage.Client
 	log *logrus.Entry
 
-	rand *rand.Rand
+	rand     *rand.Rand
+	randLock sync.Mutex
 
 	projectID string
 	filters   []string
+	zones     []string
+	regions   []string
 
 	noop bool
 
+	protectionLabel protectionLabel
+
 	archiveSerial     bool
 	archiveBucket     string
 	archiveSampleRate int64
 
 	CutoffTime time.Time
 
-	rateLimiter       ratelimit.RateLimiter
-	rateLimitMaxCalls uint64
-	rateLimitDuration time.Duration
+	ttlLabel       string
+	expiresAtLabel string
+
+	policies *policyStore
+
+	// plan collects the instances that would be cleaned up instead of
+	// cleaning them up
+	plan *plan
+
+	operationTimeout  time.Duration
+	deleteConcurrency int
+
+	// listRetryBudget is how long failing list calls are retried before
+	// giving up on the run
+	listRetryBudget time.Duration
+
+	// shutdownGracePeriod is how long in-flight cleanups may keep running
+	// once the context passed to Run is done
+	shutdownGracePeriod time.Duration
+
+	rateLimiter ratelimit.RateLimiter
+	rateLimits  rateLimits
+
+	// lastCounts holds the counts of the last run
+	lastCounts map[string]int64
 }
 
 type instanceDeletionRequest struct {
 	Instance *compute.Instance
 	Reason   string
+	Rule     string
+	Action   string
 }
 
-func (ic *instanceCleaner) Run() error {
-	ctx, span := trace.StartSpan(context.Background(), "InstanceCleanerRun")
+func (ic *instanceCleaner) Run(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "InstanceCleanerRun")
 	defer span.End()
 
 	span.AddAttributes(
@@ -69,37 +102,119 @@ func (ic *instanceCleaner) Run() error {
 	errChan := make(chan error)
 
 	go ic.fetchInstancesToDelete(ctx, instChan, errChan)
-	go func() {
-		for err := range errChan {
-			ic.log.WithField("err", err).Warn("error during instance fetch")
-		}
-	}()
+	fetchErrChan := collectFetchErrors(ic.log, "error during instance fetch", errChan)
+
+	nDeleted := int64(0)
+	nStopped := int64(0)
+	nArchived := int64(0)
+	nFailed := int64(0)
+	nSkipped := int64(0)
+
+	workCtx, cancel := withGracePeriod(ctx, ic.shutdownGracePeriod)
+	defer cancel()
+
+	runWorkers(workCtx, ic.deleteConcurrency, "InstanceDeleteWorker", func(workCtx context.Context, worker int) {
+		for req := range instChan {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&nSkipped, 1)
+				continue
+			}
 
-	nDeleted := 0
+			if ic.plan != nil {
+				ic.plan.add(ic.projectID, "instances", req.Instance.Name, req.Instance.Zone,
+					req.Instance.CreationTimestamp, req.Reason, req.Rule, req.Action,
+					req.Instance.Labels, time.Now().UTC())
+				continue
+			}
 
-	for req := range instChan {
-		err := ic.deleteInstance(ctx, req.Instance)
+			var (
+				err  error
+				done string
+			)
+
+			switch req.Action {
+			case policyActionStop:
+				err = ic.stopInstance(workCtx, req.Instance)
+				done = "stopped"
+			case policyActionArchiveOnly:
+				err = ic.archiveInstance(workCtx, req.Instance)
+				done = "archived"
+			default:
+				err = ic.deleteInstance(workCtx, req.Instance)
+				done = "deleted"
+			}
+
+			zone := filepath.Base(req.Instance.Zone)
+
+			if err != nil {
+				atomic.AddInt64(&nFailed, 1)
+				travismetrics.ResourceFailed(ic.projectID, "instances", done, zone)
+
+				ic.log.WithFields(logrus.Fields{
+					"err":      err,
+					"instance": req.Instance.Name,
+					"action":   req.Action,
+					"worker":   worker,
+				}).Warn("failed to clean up instance")
+				continue
+			}
+
+			switch req.Action {
+			case policyActionStop:
+				atomic.AddInt64(&nStopped, 1)
+			case policyActionArchiveOnly:
+				atomic.AddInt64(&nArchived, 1)
+			default:
+				atomic.AddInt64(&nDeleted, 1)
+			}
+			travismetrics.ResourceCleaned(ic.projectID, "instances", done, req.Reason, zone)
 
-		if err != nil {
 			ic.log.WithFields(logrus.Fields{
-				"err":      err,
 				"instance": req.Instance.Name,
-			}).Warn("failed to delete instance")
-			continue
+				"reason":   req.Reason,
+				"rule":     req.Rule,
+				"worker":   worker,
+			}).Info(done)
 		}
+	})
+
+	ic.lastCounts = map[string]int64{
+		"deleted":  nDeleted,
+		"stopped":  nStopped,
+		"archived": nArchived,
+		"failed":   nFailed,
+		"skipped":  nSkipped,
+	}
 
-		nDeleted++
+	projectCounter(ic.projectID, "instances.deleted", nDeleted)
+	projectCounter(ic.projectID, "instances.stopped", nStopped)
+	projectCounter(ic.projectID, "instances.archived", nArchived)
+	projectCounter(ic.projectID, "instances.failed", nFailed)
+	ic.l2met("measure#instances.stopped", int(nStopped), "counted stopped instances")
+	ic.l2met("measure#instances.archived", int(nArchived), "counted archived instances")
+	ic.l2met("measure#instances.failed", int(nFailed), "counted failed instance cleanups")
+	ic.l2met("measure#instances.deleted", int(nDeleted), "done running instance cleanup")
+
+	if nSkipped > 0 {
+		ic.log.WithField("skipped", nSkipped).Warn("skipped instances due to shutdown")
+	}
 
-		ic.log.WithFields(logrus.Fields{
-			"instance": req.Instance.Name,
-			"reason":   req.Reason,
-		}).Info("deleted")
+	fetchErr := <-fetchErrChan
+	if fetchErr != nil {
+		return fetchErr
 	}
 
-	metrics.Counter("travis.gcloud-cleanup.instances.deleted", int64(nDeleted))
-	ic.l2met("measure#instances.deleted", nDeleted, "done running instance cleanup")
+	return ctx.Err()
+}
 
-	return nil
+// instanceCounts tracks instance totals across concurrent zone fetches.
+type instanceCounts struct {
+	sync.Mutex
+
+	statuses   map[string]int
+	total      int
+	protected  int
+	invalidTTL int
 }
 
 func (ic *instanceCleaner) fetchInstancesToDelete(ctx context.Context, instChan chan *instanceDeletionRequest, errChan chan error) {
@@ -109,27 +224,77 @@ func (ic *instanceCleaner) fetchInstancesToDelete(ctx context.Context, instChan
 	defer close(errChan)
 	defer close(instChan)
 
+	counts := &instanceCounts{statuses: map[string]int{}}
+
+	if len(ic.zones) == 0 && len(ic.regions) == 0 {
+		ic.fetchAggregatedInstancesToDelete(ctx, counts, instChan, errChan)
+	} else {
+		zones, err := ic.resolveZones(ctx)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		var wg sync.WaitGroup
+
+		for _, zone := range zones {
+			wg.Add(1)
+
+			go func(zone string) {
+				defer wg.Done()
+				ic.fetchZoneInstancesToDelete(ctx, zone, counts, instChan, errChan)
+			}(zone)
+		}
+
+		wg.Wait()
+	}
+
+	for status, count := range counts.statuses {
+		key := fmt.Sprintf("gauge#instances.status.%s", status)
+		ic.l2met(key, count, "counted instances with status")
+	}
+	travismetrics.ResourceStatuses(ic.projectID, "instances", counts.statuses)
+
+	projectCounter(ic.projectID, "instances.protected", int64(counts.protected))
+	ic.l2met("gauge#instances.protected", counts.protected, "counted protected instances")
+	projectCounter(ic.projectID, "instances.invalid_ttl", int64(counts.invalidTTL))
+	ic.l2met("gauge#instances.invalid_ttl", counts.invalidTTL, "counted instances with invalid ttl labels")
+	ic.l2met("gauge#instances.count", counts.total, "done checking all instances")
+}
+
+func (ic *instanceCleaner) fetchAggregatedInstancesToDelete(ctx context.Context, counts *instanceCounts,
+	instChan chan *instanceDeletionRequest, errChan chan error) {
+
 	listCall := ic.cs.Instances.AggregatedList(ic.projectID)
 	for _, filter := range ic.filters {
 		listCall.Filter(filter)
 	}
 
 	pageTok := ""
-	statusCounts := map[string]int{}
-	nInstances := 0
 
 	for {
+		if ctx.Err() != nil {
+			return
+		}
+
 		if pageTok != "" {
 			listCall.PageToken(pageTok)
 		}
 
-		ic.apiRateLimit(ctx)
 		ic.log.WithField("page_token", pageTok).Debug("fetching instances aggregated list")
-		resp, err := listCall.Context(ctx).Do()
+
+		var resp *compute.InstanceAggregatedList
+		err := retryListCall(ctx, ic.log, ic.listRetryBudget, func() (err error) {
+			if err = ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+				return
+			}
+			resp, err = listCall.Context(ctx).Do()
+			return
+		})
 
 		if err != nil {
-			errChan <- err
-			continue
+			errChan <- errors.Wrap(err, "could not list instances")
+			return
 		}
 
 		ic.log.WithField("zones", len(resp.Items)).Debug("checking aggregated instance results")
@@ -141,79 +306,245 @@ func (ic *instanceCleaner) fetchInstancesToDelete(ctx context.Context, instChan
 			}).Debug("checking instance results in zone")
 
 			for _, inst := range list.Instances {
-				nInstances++
+				ic.checkInstance(ctx, inst, counts, instChan)
+			}
+		}
 
-				log := ic.log.WithFields(logrus.Fields{
-					"instance": inst.Name,
-				})
+		if resp.NextPageToken == "" {
+			ic.log.Debug("no next page, breaking out of loop")
+			break
+		}
 
-				if _, ok := statusCounts[inst.Status]; !ok {
-					statusCounts[inst.Status] = 0
-				}
+		ic.log.Debug("continuing to next page")
+		pageTok = resp.NextPageToken
+	}
+}
+
+func (ic *instanceCleaner) fetchZoneInstancesToDelete(ctx context.Context, zone string, counts *instanceCounts,
+	instChan chan *instanceDeletionRequest, errChan chan error) {
 
-				statusCounts[inst.Status]++
+	ctx, span := trace.StartSpan(ctx, "FetchZoneInstancesToDelete")
+	defer span.End()
 
-				ts, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+	span.AddAttributes(
+		trace.StringAttribute("zone", zone),
+	)
 
-				if err != nil {
-					log.WithField("err", err).Warn("failed to parse creation timestamp")
-					continue
-				}
+	listCall := ic.cs.Instances.List(ic.projectID, zone)
+	for _, filter := range ic.filters {
+		listCall.Filter(filter)
+	}
 
-				ts = ts.UTC()
+	pageTok := ""
+	log := ic.log.WithField("zone", zone)
 
-				log.WithFields(logrus.Fields{
-					"orig":   inst.CreationTimestamp,
-					"parsed": ts.Format(time.RFC3339),
-				}).Debug("parsed and adjusted creation timestamp")
+	for {
+		if ctx.Err() != nil {
+			return
+		}
 
-				if inst.Status == "STOPPED" {
-					log.WithFields(logrus.Fields{
-						"status": inst.Status,
-					}).Debug("sending instance for deletion")
+		if pageTok != "" {
+			listCall.PageToken(pageTok)
+		}
 
-					instChan <- &instanceDeletionRequest{Instance: inst, Reason: "stopped"}
-					continue
-				}
-				
-				if inst.Status == "TERMINATED" {
-					log.WithFields(logrus.Fields{
-						"status": inst.Status,
-					}).Debug("sending instance for deletion")
+		log.WithField("page_token", pageTok).Debug("fetching instances list")
 
-					instChan <- &instanceDeletionRequest{Instance: inst, Reason: "TERMINATED"}
-					continue
-				}
+		var resp *compute.InstanceList
+		err := retryListCall(ctx, log, ic.listRetryBudget, func() (err error) {
+			if err = ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+				return
+			}
+			resp, err = listCall.Context(ctx).Do()
+			return
+		})
 
-				if ts.Before(ic.CutoffTime) {
-					log.WithFields(logrus.Fields{
-						"created": ts.Format(time.RFC3339),
-						"cutoff":  ic.CutoffTime.Format(time.RFC3339),
-					}).Debug("sending instance for deletion")
+		if err != nil {
+			errChan <- errors.Wrap(err, "could not list instances")
+			return
+		}
 
-					instChan <- &instanceDeletionRequest{Instance: inst, Reason: "stale"}
-					continue
-				}
+		log.WithField("instances", len(resp.Items)).Debug("checking instance results in zone")
 
-				log.Debug("skipping instance")
-			}
+		for _, inst := range resp.Items {
+			ic.checkInstance(ctx, inst, counts, instChan)
 		}
 
 		if resp.NextPageToken == "" {
-			ic.log.Debug("no next page, breaking out of loop")
+			log.Debug("no next page, breaking out of loop")
 			break
 		}
 
-		ic.log.Debug("continuing to next page")
+		log.Debug("continuing to next page")
 		pageTok = resp.NextPageToken
 	}
+}
 
-	for status, count := range statusCounts {
-		key := fmt.Sprintf("gauge#instances.status.%s", status)
-		ic.l2met(key, count, "counted instances with status")
+// resolveZones returns the configured zones plus all zones of the
+// configured regions.
+func (ic *instanceCleaner) resolveZones(ctx context.Context) ([]string, error) {
+	zones := []string{}
+	seen := map[string]bool{}
+
+	addZone := func(zone string) {
+		zone = filepath.Base(zone)
+		if seen[zone] {
+			return
+		}
+		seen[zone] = true
+		zones = append(zones, zone)
+	}
+
+	for _, zone := range ic.zones {
+		addZone(zone)
+	}
+
+	for _, region := range ic.regions {
+		if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+			return nil, err
+		}
+		resp, err := ic.cs.Regions.Get(ic.projectID, region).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, zone := range resp.Zones {
+			addZone(zone)
+		}
 	}
 
-	ic.l2met("gauge#instances.count", nInstances, "done checking all instances")
+	ic.log.WithField("zones", strings.Join(zones, ",")).Debug("resolved zones")
+
+	return zones, nil
+}
+
+func (ic *instanceCleaner) checkInstance(ctx context.Context, inst *compute.Instance, counts *instanceCounts, instChan chan *instanceDeletionRequest) {
+	counts.Lock()
+	counts.total++
+	counts.statuses[inst.Status]++
+	counts.Unlock()
+
+	log := ic.log.WithFields(logrus.Fields{
+		"instance": inst.Name,
+	})
+
+	if inst.DeletionProtection || ic.protectionLabel.matches(inst.Labels) {
+		counts.Lock()
+		counts.protected++
+		counts.Unlock()
+
+		log.WithFields(logrus.Fields{
+			"deletion_protection": inst.DeletionProtection,
+			"protection_label":    ic.protectionLabel.String(),
+		}).Info("skipping protected instance")
+		return
+	}
+
+	ts, err := time.Parse(time.RFC3339, inst.CreationTimestamp)
+
+	if err != nil {
+		log.WithField("err", err).Warn("failed to parse creation timestamp")
+		return
+	}
+
+	ts = ts.UTC()
+	now := time.Now().UTC()
+
+	log.WithFields(logrus.Fields{
+		"orig":   inst.CreationTimestamp,
+		"parsed": ts.Format(time.RFC3339),
+	}).Debug("parsed and adjusted creation timestamp")
+
+	invalidTTLReported := false
+
+	for _, rule := range ic.rules(now) {
+		if !rule.matches(inst.Name, inst.Status, inst.Labels) {
+			continue
+		}
+
+		ruleLog := log.WithFields(logrus.Fields{
+			"rule":   rule.Name,
+			"status": inst.Status,
+		})
+
+		if rule.maxAge > 0 {
+			cutoff, cutoffSource, err := ic.instanceCutoff(inst, now, rule.maxAge)
+			if err != nil && !invalidTTLReported {
+				invalidTTLReported = true
+
+				counts.Lock()
+				counts.invalidTTL++
+				counts.Unlock()
+
+				log.WithField("err", err).Warn("invalid ttl label, falling back to max age")
+			}
+
+			if !ts.Before(cutoff) {
+				continue
+			}
+
+			ruleLog = ruleLog.WithFields(logrus.Fields{
+				"created":       ts.Format(time.RFC3339),
+				"cutoff":        cutoff.Format(time.RFC3339),
+				"cutoff_source": cutoffSource,
+			})
+		}
+
+		ruleLog.WithField("action", rule.Action).Debug("sending instance for cleanup")
+
+		select {
+		case instChan <- &instanceDeletionRequest{
+			Instance: inst,
+			Reason:   rule.reason(),
+			Rule:     rule.Name,
+			Action:   rule.Action,
+		}:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	log.Debug("skipping instance")
+}
+
+// rules returns the instance rules of the current policy, or the default
+// rules based on CutoffTime if there is no policy.
+func (ic *instanceCleaner) rules(now time.Time) []*policyRule {
+	if ic.policies != nil {
+		return ic.policies.instanceRules()
+	}
+	return defaultInstanceRules(now.Sub(ic.CutoffTime))
+}
+
+// instanceCutoff returns the cutoff time for the given instance along with
+// where it came from. Instances with a ttl label are stale once they are
+// older than the ttl, and instances with an expires-at label (unix seconds)
+// are stale once that time has passed. All other instances, as well as those
+// whose label value is invalid, are stale once older than maxAge.
+func (ic *instanceCleaner) instanceCutoff(inst *compute.Instance, now time.Time, maxAge time.Duration) (time.Time, string, error) {
+	fallback := now.Add(-1 * maxAge)
+
+	if value, ok := inst.Labels[ic.ttlLabel]; ok && ic.ttlLabel != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return fallback, "max-age", fmt.Errorf("invalid %s label value %q", ic.ttlLabel, value)
+		}
+		return now.Add(-1 * ttl), "ttl", nil
+	}
+
+	if value, ok := inst.Labels[ic.expiresAtLabel]; ok && ic.expiresAtLabel != "" {
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fallback, "max-age", fmt.Errorf("invalid %s label value %q", ic.expiresAtLabel, value)
+		}
+
+		if now.Before(time.Unix(secs, 0)) {
+			// not expired yet, so no creation time is old enough
+			return time.Time{}, "expires-at", nil
+		}
+		return now, "expires-at", nil
+	}
+
+	return fallback, "max-age", nil
 }
 
 func (ic *instanceCleaner) deleteInstance(ctx context.Context, inst *compute.Instance) error {
@@ -233,8 +564,100 @@ func (ic *instanceCleaner) deleteInstance(ctx context.Context, inst *compute.Ins
 		}
 	}
 
-	ic.apiRateLimit(ctx)
-	_, err := ic.cs.Instances.Delete(ic.projectID, filepath.Base(inst.Zone), inst.Name).Context(ctx).Do()
+	zone := filepath.Base(inst.Zone)
+
+	if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketDelete); err != nil {
+		return err
+	}
+	op, err := ic.cs.Instances.Delete(ic.projectID, zone, inst.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	return ic.waitForZoneOperation(ctx, inst, zone, op)
+}
+
+// getInstance looks up an instance by name across all zones.
+func (ic *instanceCleaner) getInstance(ctx context.Context, name string) (*compute.Instance, error) {
+	listCall := ic.cs.Instances.AggregatedList(ic.projectID).
+		Filter(fmt.Sprintf("name eq ^%s$", regexp.QuoteMeta(name)))
+
+	var found []*compute.Instance
+	err := retryListCall(ctx, ic.log, ic.listRetryBudget, func() error {
+		found = nil
+		if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketList); err != nil {
+			return err
+		}
+		return listCall.Pages(ctx, func(resp *compute.InstanceAggregatedList) error {
+			for _, list := range resp.Items {
+				found = append(found, list.Instances...)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list instances")
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, errors.Wrapf(errResourceNotFound, "instance %s", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, errors.Wrapf(errResourceAmbiguous, "instance %s", name)
+	}
+}
+
+func (ic *instanceCleaner) stopInstance(ctx context.Context, inst *compute.Instance) error {
+	ctx, span := trace.StartSpan(ctx, "StopInstance")
+	defer span.End()
+
+	if ic.noop {
+		ic.log.WithField("instance", inst.Name).Debug("not really stopping instance")
+		return nil
+	}
+
+	zone := filepath.Base(inst.Zone)
+
+	if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketDelete); err != nil {
+		return err
+	}
+	op, err := ic.cs.Instances.Stop(ic.projectID, zone, inst.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	return ic.waitForZoneOperation(ctx, inst, zone, op)
+}
+
+func (ic *instanceCleaner) archiveInstance(ctx context.Context, inst *compute.Instance) error {
+	ctx, span := trace.StartSpan(ctx, "ArchiveInstance")
+	defer span.End()
+
+	if ic.noop {
+		ic.log.WithField("instance", inst.Name).Debug("not really archiving instance")
+		return nil
+	}
+
+	return ic.archiveSerialConsoleOutput(ctx, inst)
+}
+
+func (ic *instanceCleaner) waitForZoneOperation(ctx context.Context, inst *compute.Instance, zone string, op *compute.Operation) error {
+	op, err := waitForOperation(ctx, op, ic.operationTimeout, func(ctx context.Context, name string) (*compute.Operation, error) {
+		if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketOperations); err != nil {
+			return nil, err
+		}
+		return ic.cs.ZoneOperations.Get(ic.projectID, zone, name).Context(ctx).Do()
+	})
+
+	ic.log.WithFields(logrus.Fields{
+		"instance":  inst.Name,
+		"operation": op.Name,
+		"type":      op.OperationType,
+		"status":    op.Status,
+	}).Debug("finished waiting for operation")
+
 	return err
 }
 
@@ -246,24 +669,34 @@ func (ic *instanceCleaner) archiveSerialConsoleOutput(ctx context.Context, inst
 	ctx, span := trace.StartSpan(ctx, "archiveSerialConsoleOutput")
 	defer span.End()
 
-	if ic.sc == nil {
-		return errNoStorageClient
-	}
-
+	ic.randLock.Lock()
 	archiveSampled := ic.rand.Float32() < (1.0 / float32(ic.archiveSampleRate))
+	ic.randLock.Unlock()
 
 	if !archiveSampled {
 		ic.log.WithField("instance", inst.Name).Debug("skipping archive due to sample rate")
 		return nil
 	}
 
+	return ic.uploadSerialConsoleOutput(ctx, inst)
+}
+
+// uploadSerialConsoleOutput copies the serial port output of the instance to
+// the archive bucket regardless of the sample rate.
+func (ic *instanceCleaner) uploadSerialConsoleOutput(ctx context.Context, inst *compute.Instance) error {
+	if ic.sc == nil {
+		return errNoStorageClient
+	}
+
 	accum := ""
 	lastPos := int64(0)
 
 	for {
-		ic.apiRateLimit(ctx)
+		if err := ic.rateLimits.wait(ctx, ic.rateLimiter, rateLimitBucketSerialOutput); err != nil {
+			return err
+		}
 		resp, err := ic.cs.Instances.GetSerialPortOutput(
-			ic.projectID, filepath.Base(inst.Zone), inst.Name).Start(lastPos).Context(ic.ctx).Do()
+			ic.projectID, filepath.Base(inst.Zone), inst.Name).Start(lastPos).Context(ctx).Do()
 
 		if err != nil {
 			return err
@@ -278,7 +711,7 @@ func (ic *instanceCleaner) archiveSerialConsoleOutput(ctx context.Context, inst
 
 	key := fmt.Sprintf("serial-console-output/%s.txt", inst.Name)
 	obj := ic.sc.Bucket(ic.archiveBucket).Object(key)
-	wc := obj.NewWriter(ic.ctx)
+	wc := obj.NewWriter(ctx)
 
 	_, err := io.Copy(wc, strings.NewReader(accum))
 	if err != nil {
@@ -300,30 +733,3 @@ func (ic *instanceCleaner) archiveSerialConsoleOutput(ctx context.Context, inst
 
 	return nil
 }
-
-func (ic *instanceCleaner) apiRateLimit(ctx context.Context) error {
-	ctx, span := trace.StartSpan(ctx, "apiRateLimit")
-	defer span.End()
-
-	ic.log.Debug("waiting for rate limiter tick")
-	errCount := 0
-
-	for {
-		ok, err := ic.rateLimiter.RateLimit("gce-api", ic.rateLimitMaxCalls, ic.rateLimitDuration)
-		if err != nil {
-			errCount++
-			if errCount >= 5 {
-				ic.log.WithField("err", err).Info("rate limiter errored 5 times")
-				return err
-			}
-		} else {
-			errCount = 0
-		}
-		if ok {
-			return nil
-		}
-
-		// Sleep for up to 1 second
-		time.Sleep(time.Millisecond * time.Duration(rand.Intn(1000)))
-	}
-}
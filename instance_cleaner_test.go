@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +19,7 @@ import (
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
 
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/travis-ci/gcloud-cleanup/ratelimit"
@@ -27,17 +31,16 @@ func TestNewInstanceCleaner(t *testing.T) {
 	cutoffTime := time.Now().Add(-1 * time.Hour)
 
 	ic := &instanceCleaner{
-		log:               log.WithField("test", "yep"),
-		rand:              rand.New(rand.NewSource(4)),
-		rateLimiter:       rl,
-		rateLimitMaxCalls: 10,
-		rateLimitDuration: time.Second,
-		CutoffTime:        cutoffTime,
-		projectID:         "foo-project",
-		filters:           []string{"name eq ^test.*"},
-		noop:              true,
-		archiveSerial:     true,
-		archiveBucket:     "walrus-meme",
+		log:           log.WithField("test", "yep"),
+		rand:          rand.New(rand.NewSource(4)),
+		rateLimiter:   rl,
+		rateLimits:    defaultRateLimits(10, time.Second),
+		CutoffTime:    cutoffTime,
+		projectID:     "foo-project",
+		filters:       []string{"name eq ^test.*"},
+		noop:          true,
+		archiveSerial: true,
+		archiveBucket: "walrus-meme",
 	}
 
 	assert.NotNil(t, ic)
@@ -75,6 +78,22 @@ func TestInstanceCleaner_Run(t *testing.T) {
 								"creationTimestamp": time.Now().Add(-8 * time.Hour).Format(time.RFC3339),
 								"zone":              "zones/us-central1-a",
 							},
+							map[string]interface{}{
+								"name":               "test-vm-3",
+								"status":             "TERMINATED",
+								"creationTimestamp":  "2016-01-02T07:11:12.999-07:00",
+								"zone":               "zones/us-central1-a",
+								"deletionProtection": true,
+							},
+							map[string]interface{}{
+								"name":              "test-vm-4",
+								"status":            "RUNNING",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"zone":              "zones/us-central1-a",
+								"labels": map[string]string{
+									"gcloud-cleanup-protect": "true",
+								},
+							},
 						},
 					},
 				},
@@ -86,13 +105,19 @@ func TestInstanceCleaner_Run(t *testing.T) {
 		"/foo-project/zones/us-central1-a/instances/test-vm-1",
 		func(w http.ResponseWriter, req *http.Request) {
 			assert.Equal(t, req.Method, "DELETE")
-			fmt.Fprintf(w, `{}`)
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
 		})
 	mux.HandleFunc(
 		"/foo-project/zones/us-central1-a/instances/test-vm-2",
 		func(w http.ResponseWriter, req *http.Request) {
 			assert.Equal(t, req.Method, "DELETE")
-			fmt.Fprintf(w, `{}`)
+			fmt.Fprintf(w, `{"name": "op-2", "status": "PENDING"}`)
+		})
+	mux.HandleFunc(
+		"/foo-project/zones/us-central1-a/operations/op-2",
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, req.Method, "GET")
+			fmt.Fprintf(w, `{"name": "op-2", "status": "DONE", "error": {"errors": [{"code": "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE"}]}}`)
 		})
 	mux.HandleFunc(
 		"/foo-project/zones/us-central1-a/instances/test-vm-1/serialPort",
@@ -119,9 +144,17 @@ func TestInstanceCleaner_Run(t *testing.T) {
 	assert.Nil(t, err)
 	cs.BasePath = srv.URL
 
+	ft := &fakeTransport{}
+	for i := 0; i < 2; i++ {
+		ft.addResult(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}, nil)
+	}
+
 	ctx := context.Background()
 	sc, err := storage.NewClient(
-		ctx, option.WithHTTPClient(&http.Client{Transport: &fakeTransport{}}))
+		ctx, option.WithHTTPClient(&http.Client{Transport: ft}))
 	assert.Nil(t, err)
 
 	log := logrus.New()
@@ -132,29 +165,426 @@ func TestInstanceCleaner_Run(t *testing.T) {
 	rl := ratelimit.NewNullRateLimiter()
 	cutoffTime := time.Now().Add(-1 * time.Hour)
 
+	ic := &instanceCleaner{
+		cs:               cs,
+		sc:               sc,
+		log:              log.WithField("test", "yep"),
+		rand:             rand.New(rand.NewSource(4)),
+		rateLimiter:      rl,
+		rateLimits:       defaultRateLimits(10, time.Second),
+		CutoffTime:       cutoffTime,
+		projectID:        "foo-project",
+		filters:          []string{"name eq ^test.*"},
+		noop:             false,
+		archiveSerial:    true,
+		archiveBucket:    "walrus-meme",
+		operationTimeout: time.Minute,
+		protectionLabel:  parseProtectionLabel("gcloud-cleanup-protect=true"),
+	}
+
+	origPollInterval := operationPollInterval
+	operationPollInterval = time.Millisecond
+	defer func() { operationPollInterval = origPollInterval }()
+
+	deletedCounter := gometrics.GetOrRegisterCounter("travis.gcloud-cleanup.instances.deleted", gometrics.DefaultRegistry)
+	failedCounter := gometrics.GetOrRegisterCounter("travis.gcloud-cleanup.instances.failed", gometrics.DefaultRegistry)
+	protectedCounter := gometrics.GetOrRegisterCounter("travis.gcloud-cleanup.instances.protected", gometrics.DefaultRegistry)
+	deletedBefore, failedBefore := deletedCounter.Count(), failedCounter.Count()
+	protectedBefore := protectedCounter.Count()
+
+	err = ic.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deletedCounter.Count()-deletedBefore)
+	assert.Equal(t, int64(1), failedCounter.Count()-failedBefore)
+	assert.Equal(t, int64(2), protectedCounter.Count()-protectedBefore)
+}
+
+func TestInstanceCleaner_Run_zones(t *testing.T) {
+	var mu sync.Mutex
+	deleted := map[string]bool{}
+
+	zoneList := func(zone string, names ...string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "DELETE" {
+				t.Errorf("unexpected DELETE for %v", req.URL)
+				return
+			}
+
+			items := []interface{}{}
+			for _, name := range names {
+				items = append(items, map[string]string{
+					"name":              name,
+					"status":            "RUNNING",
+					"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+					"zone":              "zones/" + zone,
+				})
+			}
+			err := json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+			assert.Nil(t, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/regions/us-east1",
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, `{"name": "us-east1", "zones": ["https://www.googleapis.com/compute/v1/projects/foo-project/zones/us-east1-b", "https://www.googleapis.com/compute/v1/projects/foo-project/zones/us-central1-a"]}`)
+		})
+	mux.HandleFunc("/foo-project/zones/us-central1-a/instances", zoneList("us-central1-a", "test-vm-0"))
+	mux.HandleFunc("/foo-project/zones/us-east1-b/instances", zoneList("us-east1-b", "test-vm-1", "test-vm-2"))
+	mux.HandleFunc("/foo-project/zones/",
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, req.Method, "DELETE")
+			mu.Lock()
+			deleted[filepath.Base(req.URL.Path)] = true
+			mu.Unlock()
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+	if os.Getenv("GCLOUD_CLEANUP_TEST_DEBUG") != "" {
+		log.Level = logrus.DebugLevel
+	}
+
 	ic := &instanceCleaner{
 		cs:                cs,
-		sc:                sc,
 		log:               log.WithField("test", "yep"),
 		rand:              rand.New(rand.NewSource(4)),
-		rateLimiter:       rl,
-		rateLimitMaxCalls: 10,
-		rateLimitDuration: time.Second,
-		CutoffTime:        cutoffTime,
+		rateLimiter:       ratelimit.NewNullRateLimiter(),
+		rateLimits:        defaultRateLimits(10, time.Second),
+		CutoffTime:        time.Now().Add(-1 * time.Hour),
 		projectID:         "foo-project",
 		filters:           []string{"name eq ^test.*"},
-		noop:              false,
-		archiveSerial:     true,
-		archiveBucket:     "walrus-meme",
+		zones:             []string{"us-central1-a"},
+		regions:           []string{"us-east1"},
+		operationTimeout:  time.Minute,
+		deleteConcurrency: 2,
+	}
+
+	err = ic.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{
+		"test-vm-0": true,
+		"test-vm-1": true,
+		"test-vm-2": true,
+	}, deleted)
+}
+
+func TestInstanceCleaner_Run_policy(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]bool{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/aggregated/instances",
+		func(w http.ResponseWriter, req *http.Request) {
+			body := map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/us-central1-a": map[string]interface{}{
+						"instances": []interface{}{
+							map[string]string{
+								"name":              "test-debug-vm-0",
+								"status":            "RUNNING",
+								"creationTimestamp": time.Now().Add(-80 * time.Hour).Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]string{
+								"name":              "test-debug-vm-1",
+								"status":            "RUNNING",
+								"creationTimestamp": time.Now().Add(-8 * time.Hour).Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]string{
+								"name":              "test-vm-0",
+								"status":            "TERMINATED",
+								"creationTimestamp": time.Now().Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]string{
+								"name":              "test-vm-1",
+								"status":            "STOPPED",
+								"creationTimestamp": "2016-01-02T07:11:12.999-07:00",
+								"zone":              "zones/us-central1-a",
+							},
+						},
+					},
+				},
+			}
+			err := json.NewEncoder(w).Encode(body)
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc("/foo-project/zones/us-central1-a/instances/",
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			calls[req.Method+" "+req.URL.Path] = true
+			mu.Unlock()
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+	if os.Getenv("GCLOUD_CLEANUP_TEST_DEBUG") != "" {
+		log.Level = logrus.DebugLevel
+	}
+
+	p := &policy{
+		Instances: []*policyRule{
+			{Name: "debug-vms", Filter: "^test-debug-", MaxAge: "72h", Action: policyActionStop},
+			{Name: "terminated", Statuses: []string{"TERMINATED"}, Action: policyActionDelete},
+		},
+	}
+	assert.Nil(t, p.validate())
+
+	ic := &instanceCleaner{
+		cs:               cs,
+		log:              log.WithField("test", "yep"),
+		rand:             rand.New(rand.NewSource(4)),
+		rateLimiter:      ratelimit.NewNullRateLimiter(),
+		rateLimits:       defaultRateLimits(10, time.Second),
+		CutoffTime:       time.Now().Add(-1 * time.Hour),
+		projectID:        "foo-project",
+		operationTimeout: time.Minute,
+		policies:         &policyStore{policy: p},
+	}
+
+	err = ic.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{
+		"POST /foo-project/zones/us-central1-a/instances/test-debug-vm-0/stop": true,
+		"DELETE /foo-project/zones/us-central1-a/instances/test-vm-0":          true,
+	}, calls)
+}
+
+func TestInstanceCleaner_Run_plan(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/aggregated/instances",
+		func(w http.ResponseWriter, req *http.Request) {
+			body := map[string]interface{}{
+				"items": map[string]interface{}{
+					"zones/us-central1-a": map[string]interface{}{
+						"instances": []interface{}{
+							map[string]interface{}{
+								"name":              "test-vm-0",
+								"status":            "RUNNING",
+								"creationTimestamp": time.Now().Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+							},
+							map[string]interface{}{
+								"name":              "test-vm-1",
+								"status":            "TERMINATED",
+								"creationTimestamp": time.Now().Add(-2 * time.Hour).Format(time.RFC3339),
+								"zone":              "zones/us-central1-a",
+								"labels":            map[string]string{"role": "worker"},
+							},
+						},
+					},
+				},
+			}
+			err := json.NewEncoder(w).Encode(body)
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("Unhandled URL: %s %v", req.Method, req.URL)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	ic := &instanceCleaner{
+		cs:            cs,
+		log:           log.WithField("test", "yep"),
+		rand:          rand.New(rand.NewSource(4)),
+		rateLimiter:   ratelimit.NewNullRateLimiter(),
+		rateLimits:    defaultRateLimits(10, time.Second),
+		CutoffTime:    time.Now().Add(-1 * time.Hour),
+		projectID:     "foo-project",
+		archiveSerial: true,
+		plan:          newPlan(),
 	}
 
-	err = ic.Run()
+	err = ic.Run(context.Background())
 	assert.Nil(t, err)
+	assert.Len(t, ic.plan.Entries, 1)
+
+	entry := ic.plan.Entries[0]
+	assert.Equal(t, "instances", entry.Entity)
+	assert.Equal(t, "test-vm-1", entry.Name)
+	assert.Equal(t, "us-central1-a", entry.Zone)
+	assert.Equal(t, "TERMINATED", entry.Reason)
+	assert.Equal(t, "TERMINATED", entry.Rule)
+	assert.Equal(t, policyActionDelete, entry.Action)
+	assert.True(t, strings.HasPrefix(entry.Age, "2h0m"), entry.Age)
+	assert.Equal(t, map[string]string{"role": "worker"}, entry.Labels)
+}
+
+func TestInstanceCleaner_Run_listErrors(t *testing.T) {
+	for _, tc := range []struct {
+		failures      int
+		code          int
+		expectedCalls int
+		expectErr     bool
+	}{
+		{failures: 2, code: http.StatusServiceUnavailable, expectedCalls: 3, expectErr: false},
+		{failures: 100, code: http.StatusForbidden, expectedCalls: 1, expectErr: true},
+		{failures: 100, code: http.StatusNotFound, expectedCalls: 1, expectErr: true},
+	} {
+		calls := 0
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(
+			"/foo-project/aggregated/instances",
+			func(w http.ResponseWriter, req *http.Request) {
+				calls++
+				if calls <= tc.failures {
+					w.WriteHeader(tc.code)
+					fmt.Fprintf(w, `{"error": {"code": %d, "message": "nope"}}`, tc.code)
+					return
+				}
+				fmt.Fprintf(w, `{"items": {}}`)
+			})
+
+		srv := httptest.NewServer(mux)
+
+		cs, err := compute.New(&http.Client{})
+		assert.Nil(t, err)
+		cs.BasePath = srv.URL
+
+		log := logrus.New()
+		log.Level = logrus.FatalLevel
+
+		ic := &instanceCleaner{
+			cs:              cs,
+			log:             log.WithField("test", "yep"),
+			rand:            rand.New(rand.NewSource(4)),
+			rateLimiter:     ratelimit.NewNullRateLimiter(),
+			rateLimits:      defaultRateLimits(10, time.Second),
+			CutoffTime:      time.Now().Add(-1 * time.Hour),
+			projectID:       "foo-project",
+			listRetryBudget: time.Second,
+		}
+
+		err = ic.Run(context.Background())
+		srv.Close()
+
+		assert.Equal(t, tc.expectedCalls, calls, "code %d", tc.code)
+		if tc.expectErr {
+			assert.NotNil(t, err, "code %d", tc.code)
+		} else {
+			assert.Nil(t, err, "code %d", tc.code)
+		}
+	}
+}
+
+func TestInstanceCleaner_instanceCutoff(t *testing.T) {
+	now := time.Now().UTC()
+	cutoffTime := now.Add(-3 * time.Hour)
+
+	ic := &instanceCleaner{
+		ttlLabel:       "ttl",
+		expiresAtLabel: "expires-at",
+	}
+
+	for _, tc := range []struct {
+		labels map[string]string
+		cutoff time.Time
+		source string
+		err    bool
+	}{
+		{labels: nil, cutoff: cutoffTime, source: "max-age"},
+		{labels: map[string]string{"ttl": "10m"}, cutoff: now.Add(-10 * time.Minute), source: "ttl"},
+		{labels: map[string]string{"ttl": "72h"}, cutoff: now.Add(-72 * time.Hour), source: "ttl"},
+		{labels: map[string]string{"ttl": "forever"}, cutoff: cutoffTime, source: "max-age", err: true},
+		{labels: map[string]string{"ttl": "-1h"}, cutoff: cutoffTime, source: "max-age", err: true},
+		{labels: map[string]string{"expires-at": fmt.Sprintf("%d", now.Add(-time.Minute).Unix())}, cutoff: now, source: "expires-at"},
+		{labels: map[string]string{"expires-at": fmt.Sprintf("%d", now.Add(time.Minute).Unix())}, cutoff: time.Time{}, source: "expires-at"},
+		{labels: map[string]string{"expires-at": "tomorrow"}, cutoff: cutoffTime, source: "max-age", err: true},
+	} {
+		cutoff, source, err := ic.instanceCutoff(&compute.Instance{Labels: tc.labels}, now, 3*time.Hour)
+		assert.Equal(t, tc.cutoff, cutoff, "labels=%v", tc.labels)
+		assert.Equal(t, tc.source, source, "labels=%v", tc.labels)
+		assert.Equal(t, tc.err, err != nil, "labels=%v", tc.labels)
+	}
 }
 
 // {
 // lifted from:
 // https://github.com/GoogleCloudPlatform/google-cloud-go/blob/75763d24f38012ba2bb6f3966a39a6f0759a353c/storage/writer_test.go#L37-L68
+func TestInstanceCleaner_uploadSerialConsoleOutput(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/zones/us-central1-a/instances/test-vm-0/serialPort",
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("start") == "6" {
+				fmt.Fprintf(w, `{"next": "6"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"contents": "booted", "next": "6"}`)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	ft := &fakeTransport{}
+	ft.addResult(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+	}, nil)
+
+	sc, err := storage.NewClient(
+		context.Background(), option.WithHTTPClient(&http.Client{Transport: ft}))
+	assert.Nil(t, err)
+
+	ic := &instanceCleaner{
+		cs:          cs,
+		sc:          sc,
+		log:         logrus.New().WithField("test", "yep"),
+		rateLimiter: ratelimit.NewNullRateLimiter(),
+		rateLimits:  defaultRateLimits(10, time.Second),
+		projectID:   "foo-project",
+
+		archiveBucket: "walrus-meme",
+	}
+
+	inst := &compute.Instance{Name: "test-vm-0", Zone: "zones/us-central1-a"}
+
+	err = ic.uploadSerialConsoleOutput(context.Background(), inst)
+	assert.Nil(t, err)
+	assert.NotNil(t, ft.gotReq)
+	assert.Contains(t, string(ft.gotBody), "booted")
+}
+
 type fakeTransport struct {
 	gotReq  *http.Request
 	gotBody []byte
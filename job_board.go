@@ -1,6 +1,7 @@
 package gcloudcleanup
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -17,7 +18,7 @@ type jobBoardImageRef struct {
 	Name string `json:"name"`
 }
 
-func makeJobBoardImagesRequest(urlString string) (*jobBoardImagesResponse, error) {
+func makeJobBoardImagesRequest(ctx context.Context, urlString string) (*jobBoardImagesResponse, error) {
 	var responseBody []byte
 
 	b := backoff.NewExponentialBackOff()
@@ -25,15 +26,19 @@ func makeJobBoardImagesRequest(urlString string) (*jobBoardImagesResponse, error
 	b.MaxElapsedTime = time.Minute
 
 	err := backoff.Retry(func() (err error) {
-		resp, err := http.Get(urlString)
+		req, err := http.NewRequest("GET", urlString, nil)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
 
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 		responseBody, err = ioutil.ReadAll(resp.Body)
 		return
-	}, b)
+	}, backoff.WithContext(b, ctx))
 
 	if err != nil {
 		return nil, err
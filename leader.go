@@ -0,0 +1,214 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/sirupsen/logrus"
+
+	travismetrics "github.com/travis-ci/gcloud-cleanup/metrics"
+)
+
+// acquireLeaseScript takes or extends the lease if it is free or already held
+// by the given id, returning 1 if it is now held by it and 0 otherwise.
+//
+// KEYS[1] is the lease key, ARGV[1] the id and ARGV[2] the TTL in
+// milliseconds.
+var acquireLeaseScript = redis.NewScript(1, `
+local holder = redis.call("GET", KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// releaseLeaseScript deletes the lease if it is held by the given id.
+//
+// KEYS[1] is the lease key and ARGV[1] the id.
+var releaseLeaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// leaderLease is a lease in Redis held by at most one replica at a time,
+// which expires unless renewed within its TTL.
+type leaderLease struct {
+	pool *redis.Pool
+	key  string
+	id   string
+	ttl  time.Duration
+}
+
+// acquire takes or renews the lease, returning whether it is held by us and
+// the id of whoever holds it.
+func (l *leaderLease) acquire() (bool, string, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Int(acquireLeaseScript.Do(conn, l.key, l.id, int64(l.ttl/time.Millisecond)))
+	if err != nil {
+		return false, "", err
+	}
+	if ok == 1 {
+		return true, l.id, nil
+	}
+
+	holder, err := redis.String(conn.Do("GET", l.key))
+	if err == redis.ErrNil {
+		// the lease expired in the meantime
+		return false, "", nil
+	}
+	return false, holder, err
+}
+
+// release gives up the lease if it is held by us, so that another replica
+// doesn't have to wait for it to expire.
+func (l *leaderLease) release() error {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseLeaseScript.Do(conn, l.key, l.id)
+	return err
+}
+
+// leaderElection makes sure only one replica cleans up at a time. The leader
+// renews its lease while cleaning up, and gives up leading as soon as a
+// renewal fails.
+type leaderElection struct {
+	lease  *leaderLease
+	log    *logrus.Entry
+	status *runStatus
+
+	mutex  sync.Mutex
+	holder string
+}
+
+func newLeaderElection(pool *redis.Pool, key, id string, ttl time.Duration, log *logrus.Logger, status *runStatus) *leaderElection {
+	return &leaderElection{
+		lease: &leaderLease{
+			pool: pool,
+			key:  key,
+			id:   id,
+			ttl:  ttl,
+		},
+		log:    log.WithField("leader_id", id),
+		status: status,
+	}
+}
+
+// defaultLeaderID identifies this replica by host name and process id.
+func defaultLeaderID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// leaseLostKey is the context key of the channel closed when the leader lease
+// held for a context is lost.
+type leaseLostKey struct{}
+
+// leaseLost returns a channel that is closed once the leader lease held for
+// ctx is lost, or nil if ctx doesn't come from lead.
+func leaseLost(ctx context.Context) <-chan struct{} {
+	lost, _ := ctx.Value(leaseLostKey{}).(chan struct{})
+	return lost
+}
+
+// lead tries to become the leader. If that works, the lease is renewed until
+// stop is called, and the returned context is cancelled if it is lost.
+// Otherwise false is returned and the current leader is logged.
+//
+// As another replica may take over as soon as the lease is lost, work on the
+// returned context doesn't get the shutdown grace period then, see
+// withGracePeriod.
+func (le *leaderElection) lead(ctx context.Context) (context.Context, func(), bool) {
+	ok, holder, err := le.lease.acquire()
+	if err != nil {
+		le.log.WithField("err", err).Error("failed to acquire leader lease")
+		le.setHolder("")
+		return ctx, func() {}, false
+	}
+
+	le.setHolder(holder)
+
+	if !ok {
+		le.log.WithField("leader", holder).Info("another replica is leading, not cleaning up")
+		return ctx, func() {}, false
+	}
+
+	lost := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, leaseLostKey{}, lost))
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(le.lease.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ok, holder, err := le.lease.acquire()
+			if err != nil || !ok {
+				le.log.WithFields(logrus.Fields{
+					"err":    err,
+					"leader": holder,
+				}).Error("lost leader lease, stopping cleanup")
+				le.setHolder(holder)
+				close(lost)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel()
+	}, true
+}
+
+// release gives up the lease on shutdown.
+func (le *leaderElection) release() {
+	err := le.lease.release()
+	if err != nil {
+		le.log.WithField("err", err).Error("failed to release leader lease")
+		return
+	}
+	le.setHolder("")
+	le.log.Info("released leader lease")
+}
+
+// setHolder records the current leader, logging changes and reporting it in
+// metrics and the status endpoint.
+func (le *leaderElection) setHolder(holder string) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+
+	if holder != le.holder {
+		le.log.WithFields(logrus.Fields{
+			"leader":          holder,
+			"previous_leader": le.holder,
+		}).Info("leader changed")
+	}
+	le.holder = holder
+
+	travismetrics.Leader(le.lease.id, holder)
+	le.status.setLeader(holder)
+}
@@ -0,0 +1,115 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+func newTestLeaderElection(t *testing.T, mr *miniredis.Miniredis, id string, ttl time.Duration) *leaderElection {
+	pool, err := ratelimit.NewRedisPool(ratelimit.RedisConfig{URL: "redis://" + mr.Addr()})
+	assert.Nil(t, err)
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	return newLeaderElection(pool, "test:leader", id, ttl, log, newRunStatus(time.Minute, time.Now()))
+}
+
+func TestLeaderLease(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	a := newTestLeaderElection(t, mr, "a", time.Minute).lease
+	b := newTestLeaderElection(t, mr, "b", time.Minute).lease
+
+	ok, holder, err := a.acquire()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "a", holder)
+	assert.Equal(t, time.Minute, mr.TTL("test:leader"))
+
+	ok, holder, err = b.acquire()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "a", holder)
+
+	mr.FastForward(30 * time.Second)
+	ok, _, err = a.acquire()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, mr.TTL("test:leader"))
+
+	assert.Nil(t, b.release())
+	assert.True(t, mr.Exists("test:leader"))
+
+	assert.Nil(t, a.release())
+	assert.False(t, mr.Exists("test:leader"))
+
+	ok, holder, err = b.acquire()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "b", holder)
+
+	mr.FastForward(time.Minute)
+	ok, holder, err = a.acquire()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "a", holder)
+}
+
+func TestLeaderElection_lead(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	a := newTestLeaderElection(t, mr, "a", 30*time.Millisecond)
+	b := newTestLeaderElection(t, mr, "b", 30*time.Millisecond)
+
+	ctx, stop, leading := a.lead(context.Background())
+	assert.True(t, leading)
+
+	_, _, leading = b.lead(context.Background())
+	assert.False(t, leading)
+	assert.Equal(t, "a", b.status.snapshot(time.Now())["leader"])
+
+	// renewals keep the lease
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, ctx.Err())
+	stop()
+	assert.NotNil(t, ctx.Err())
+
+	ctx, stop, leading = a.lead(context.Background())
+	assert.True(t, leading)
+	defer stop()
+
+	workCtx, cancel := withGracePeriod(ctx, time.Hour)
+	defer cancel()
+
+	// another replica took over the lease
+	mr.Set("test:leader", "b")
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected losing the lease to cancel the context")
+	}
+
+	// in-flight work doesn't get the grace period without the lease
+	select {
+	case <-workCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected losing the lease to skip the grace period")
+	}
+	assert.Equal(t, "b", a.status.snapshot(time.Now())["leader"])
+
+	b.release()
+	assert.False(t, mr.Exists("test:leader"))
+}
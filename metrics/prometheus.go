@@ -0,0 +1,264 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	registryPrefix      = "travis.gcloud-cleanup."
+	prometheusNamespace = "gcloud_cleanup"
+)
+
+var (
+	// PrometheusRegistry holds the labelled series reported via the functions
+	// below. The go-metrics registry is bridged in PrometheusHandler.
+	PrometheusRegistry = prometheus.NewRegistry()
+
+	resourcesCleaned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "resources_cleaned_total",
+		Help:      "Resources cleaned up, by project, entity, action, reason and zone.",
+	}, []string{"project", "entity", "action", "reason", "zone"})
+
+	resourcesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "resources_failed_total",
+		Help:      "Resources that failed to be cleaned up, by project, entity, action and zone.",
+	}, []string{"project", "entity", "action", "zone"})
+
+	resourceStatuses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "resources",
+		Help:      "Resources seen during the last cleanup run, by project, entity and status.",
+	}, []string{"project", "entity", "status"})
+
+	rateLimitCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "rate_limit_calls_total",
+		Help:      "Calls asked for by rate limiter name and whether they were admitted or denied.",
+	}, []string{"name", "result"})
+
+	rateLimitWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time spent waiting for the rate limiter by rate limiter name.",
+		Buckets:   []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60},
+	}, []string{"name"})
+
+	leader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "leader",
+		Help:      "Whether the replica with the given id is the leader, as last seen by this replica.",
+	}, []string{"id"})
+
+	reportedStatuses     = map[string]map[string]bool{}
+	reportedStatusesLock sync.Mutex
+
+	reportedLeader     string
+	reportedLeaderLock sync.Mutex
+
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+func init() {
+	PrometheusRegistry.MustRegister(resourcesCleaned, resourcesFailed, resourceStatuses, rateLimitCalls, rateLimitWait, leader)
+}
+
+// ResourceCleaned counts a resource cleaned up with the given action. An empty
+// zone is reported as "global".
+func ResourceCleaned(project, entity, action, reason, zone string) {
+	resourcesCleaned.WithLabelValues(project, entity, action, reason, globalZone(zone)).Inc()
+}
+
+// ResourceFailed counts a resource that failed to be cleaned up with the given
+// action. An empty zone is reported as "global".
+func ResourceFailed(project, entity, action, zone string) {
+	resourcesFailed.WithLabelValues(project, entity, action, globalZone(zone)).Inc()
+}
+
+// ResourceStatuses sets the number of resources per status seen in the last
+// run, resetting statuses reported before but not seen this time.
+func ResourceStatuses(project, entity string, counts map[string]int) {
+	reportedStatusesLock.Lock()
+	defer reportedStatusesLock.Unlock()
+
+	key := project + "/" + entity
+	if _, ok := reportedStatuses[key]; !ok {
+		reportedStatuses[key] = map[string]bool{}
+	}
+
+	for status := range reportedStatuses[key] {
+		if _, ok := counts[status]; !ok {
+			resourceStatuses.WithLabelValues(project, entity, status).Set(0)
+		}
+	}
+
+	for status, count := range counts {
+		reportedStatuses[key][status] = true
+		resourceStatuses.WithLabelValues(project, entity, status).Set(float64(count))
+	}
+}
+
+// RateLimitAdmitted counts a call let through by the rate limiter with the
+// given name.
+func RateLimitAdmitted(name string) {
+	Mark(registryPrefix + "rate_limit." + name + ".admitted")
+	rateLimitCalls.WithLabelValues(name, "admitted").Inc()
+}
+
+// RateLimitDenied counts a call held back by the rate limiter with the given
+// name.
+func RateLimitDenied(name string) {
+	Mark(registryPrefix + "rate_limit." + name + ".denied")
+	rateLimitCalls.WithLabelValues(name, "denied").Inc()
+}
+
+// RateLimitWait reports the time spent waiting since the given time for the
+// rate limiter with the given name to let a call through.
+func RateLimitWait(name string, since time.Time) {
+	duration := time.Since(since)
+	TimeDuration(registryPrefix+"rate_limit."+name+".wait", duration)
+	rateLimitWait.WithLabelValues(name).Observe(duration.Seconds())
+}
+
+// Leader reports the id of the current leader, or an empty string if there is
+// none, as seen by the replica with the given id.
+func Leader(id, holder string) {
+	reportedLeaderLock.Lock()
+	defer reportedLeaderLock.Unlock()
+
+	if reportedLeader != "" && reportedLeader != holder {
+		leader.WithLabelValues(reportedLeader).Set(0)
+	}
+	if holder != "" {
+		leader.WithLabelValues(holder).Set(1)
+	}
+	reportedLeader = holder
+
+	isLeader := int64(0)
+	if id == holder {
+		isLeader = 1
+	}
+	Gauge(registryPrefix+"leading", isLeader)
+}
+
+// PrometheusHandler serves the labelled series along with every metric of the
+// go-metrics default registry in the Prometheus text format.
+func PrometheusHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{
+		PrometheusRegistry,
+		&registryGatherer{registry: metrics.DefaultRegistry},
+	}, promhttp.HandlerOpts{})
+}
+
+func globalZone(zone string) string {
+	if zone == "" {
+		return "global"
+	}
+	return zone
+}
+
+// registryGatherer converts the metrics of a go-metrics registry into
+// Prometheus metric families. Per-project copies of metrics are skipped, as
+// the labelled series already cover them.
+type registryGatherer struct {
+	registry metrics.Registry
+}
+
+func (rg *registryGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families := []*dto.MetricFamily{}
+
+	rg.registry.Each(func(name string, i interface{}) {
+		if !strings.HasPrefix(name, registryPrefix) || strings.HasPrefix(name, registryPrefix+"projects.") {
+			return
+		}
+
+		name = prometheusName(strings.TrimPrefix(name, registryPrefix))
+
+		switch m := i.(type) {
+		case metrics.Counter:
+			families = append(families, valueFamily(name, dto.MetricType_COUNTER, float64(m.Count())))
+		case metrics.Gauge:
+			families = append(families, valueFamily(name, dto.MetricType_GAUGE, float64(m.Value())))
+		case metrics.GaugeFloat64:
+			families = append(families, valueFamily(name, dto.MetricType_GAUGE, m.Value()))
+		case metrics.Meter:
+			families = append(families, valueFamily(name, dto.MetricType_COUNTER, float64(m.Count())))
+		case metrics.Timer:
+			t := m.Snapshot()
+			families = append(families, summaryFamily(name+"_seconds", t.Count(),
+				float64(t.Sum())/float64(time.Second), t.Percentiles, float64(time.Second)))
+		case metrics.Histogram:
+			h := m.Snapshot()
+			families = append(families, summaryFamily(name, h.Count(), float64(h.Sum()), h.Percentiles, 1))
+		}
+	})
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	return families, nil
+}
+
+var summaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+func valueFamily(name string, metricType dto.MetricType, value float64) *dto.MetricFamily {
+	metric := &dto.Metric{}
+
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(value)}
+	default:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	}
+
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Help:   proto.String("Bridged from go-metrics."),
+		Type:   metricType.Enum(),
+		Metric: []*dto.Metric{metric},
+	}
+}
+
+func summaryFamily(name string, count int64, sum float64, percentiles func([]float64) []float64, unit float64) *dto.MetricFamily {
+	quantiles := []*dto.Quantile{}
+	for i, value := range percentiles(summaryQuantiles) {
+		quantiles = append(quantiles, &dto.Quantile{
+			Quantile: proto.Float64(summaryQuantiles[i]),
+			Value:    proto.Float64(value / unit),
+		})
+	}
+
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("Bridged from go-metrics."),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(uint64(count)),
+					SampleSum:   proto.Float64(sum),
+					Quantile:    quantiles,
+				},
+			},
+		},
+	}
+}
+
+// prometheusName turns a dotted go-metrics name into a valid Prometheus metric
+// name, e.g. "instances.deleted" into "gcloud_cleanup_instances_deleted".
+func prometheusName(name string) string {
+	return prometheusNamespace + "_" + invalidNameChars.ReplaceAllString(name, "_")
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	Counter("travis.gcloud-cleanup.test.deleted", 3)
+	Counter("travis.gcloud-cleanup.projects.foo.test.deleted", 3)
+	TimeDuration("travis.gcloud-cleanup.test.duration", 2*time.Second)
+
+	ResourceCleaned("foo", "instances", "deleted", "stale", "us-central1-a")
+	ResourceFailed("foo", "images", "deleted", "")
+	ResourceStatuses("foo", "instances", map[string]int{"RUNNING": 2, "TERMINATED": 1})
+	ResourceStatuses("foo", "instances", map[string]int{"RUNNING": 4})
+	RateLimitAdmitted("gce-api-list")
+	RateLimitAdmitted("gce-api-list")
+	RateLimitDenied("gce-api-list")
+	RateLimitWait("gce-api-list", time.Now())
+	Leader("a", "b")
+	Leader("a", "a")
+
+	w := httptest.NewRecorder()
+	PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+
+	body, err := ioutil.ReadAll(w.Body)
+	assert.Nil(t, err)
+	out := string(body)
+
+	assert.Contains(t, out, "gcloud_cleanup_test_deleted 3")
+	assert.NotContains(t, out, "gcloud_cleanup_projects_foo")
+	assert.Contains(t, out, "gcloud_cleanup_test_duration_seconds_sum 2")
+	assert.Contains(t, out, `gcloud_cleanup_resources_cleaned_total{action="deleted",entity="instances",project="foo",reason="stale",zone="us-central1-a"} 1`)
+	assert.Contains(t, out, `gcloud_cleanup_resources_failed_total{action="deleted",entity="images",project="foo",zone="global"} 1`)
+	assert.Contains(t, out, `gcloud_cleanup_resources{entity="instances",project="foo",status="RUNNING"} 4`)
+	assert.Contains(t, out, `gcloud_cleanup_resources{entity="instances",project="foo",status="TERMINATED"} 0`)
+	assert.Contains(t, out, `gcloud_cleanup_rate_limit_calls_total{name="gce-api-list",result="admitted"} 2`)
+	assert.Contains(t, out, `gcloud_cleanup_rate_limit_calls_total{name="gce-api-list",result="denied"} 1`)
+	assert.Contains(t, out, `gcloud_cleanup_rate_limit_wait_seconds_count{name="gce-api-list"} 1`)
+	assert.Contains(t, out, "gcloud_cleanup_rate_limit_gce_api_list_admitted 2")
+	assert.Contains(t, out, `gcloud_cleanup_leader{id="a"} 1`)
+	assert.Contains(t, out, `gcloud_cleanup_leader{id="b"} 0`)
+	assert.Contains(t, out, "gcloud_cleanup_leading 1")
+}
@@ -0,0 +1,77 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+var (
+	errOperationTimeout = errors.New("timed out waiting for operation")
+
+	operationPollInterval = 2 * time.Second
+)
+
+type operationGetter func(ctx context.Context, name string) (*compute.Operation, error)
+
+// operationError is returned for operations that reached DONE with errors.
+type operationError struct {
+	op *compute.Operation
+}
+
+func (oe *operationError) Error() string {
+	msgs := []string{}
+	for _, e := range oe.op.Error.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+
+	return fmt.Sprintf("operation %s failed: %s", oe.op.Name, strings.Join(msgs, "; "))
+}
+
+// waitForOperation polls an operation via get until it is DONE or the timeout
+// expires. The last seen state of the operation is always returned alongside
+// any error so that callers may log it.
+func waitForOperation(parent context.Context, op *compute.Operation, timeout time.Duration, get operationGetter) (*compute.Operation, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	for op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return op, waitError(parent, ctx)
+		case <-time.After(operationPollInterval):
+		}
+
+		newOp, err := get(ctx, op.Name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return op, waitError(parent, ctx)
+			}
+			return op, errors.Wrap(err, "failed to get operation")
+		}
+
+		op = newOp
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return op, &operationError{op: op}
+	}
+
+	return op, nil
+}
+
+// waitError tells the operation's own timeout apart from the parent context
+// being done.
+func waitError(parent, ctx context.Context) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errOperationTimeout
+	}
+	return ctx.Err()
+}
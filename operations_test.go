@@ -0,0 +1,87 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestWaitForOperation(t *testing.T) {
+	origPollInterval := operationPollInterval
+	operationPollInterval = time.Millisecond
+	defer func() { operationPollInterval = origPollInterval }()
+
+	calls := 0
+	op, err := waitForOperation(context.Background(),
+		&compute.Operation{Name: "op-0", Status: "PENDING"}, time.Minute,
+		func(ctx context.Context, name string) (*compute.Operation, error) {
+			assert.Equal(t, "op-0", name)
+			calls++
+			if calls < 3 {
+				return &compute.Operation{Name: name, Status: "RUNNING"}, nil
+			}
+			return &compute.Operation{Name: name, Status: "DONE"}, nil
+		})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "DONE", op.Status)
+	assert.Equal(t, 3, calls)
+}
+
+func TestWaitForOperation_failed(t *testing.T) {
+	op, err := waitForOperation(context.Background(),
+		&compute.Operation{
+			Name:   "op-0",
+			Status: "DONE",
+			Error: &compute.OperationError{
+				Errors: []*compute.OperationErrorErrors{
+					{Code: "RESOURCE_NOT_FOUND", Message: "gone"},
+				},
+			},
+		}, time.Minute,
+		func(ctx context.Context, name string) (*compute.Operation, error) {
+			t.Errorf("unexpected operation get")
+			return nil, nil
+		})
+
+	assert.NotNil(t, err)
+	assert.IsType(t, &operationError{}, err)
+	assert.Equal(t, "operation op-0 failed: RESOURCE_NOT_FOUND: gone", err.Error())
+	assert.Equal(t, "DONE", op.Status)
+}
+
+func TestWaitForOperation_timeout(t *testing.T) {
+	origPollInterval := operationPollInterval
+	operationPollInterval = time.Millisecond
+	defer func() { operationPollInterval = origPollInterval }()
+
+	op, err := waitForOperation(context.Background(),
+		&compute.Operation{Name: "op-0", Status: "PENDING"}, 20*time.Millisecond,
+		func(ctx context.Context, name string) (*compute.Operation, error) {
+			return &compute.Operation{Name: name, Status: "RUNNING"}, nil
+		})
+
+	assert.Equal(t, errOperationTimeout, err)
+	assert.Equal(t, "RUNNING", op.Status)
+}
+
+func TestWaitForOperation_cancelled(t *testing.T) {
+	origPollInterval := operationPollInterval
+	operationPollInterval = time.Millisecond
+	defer func() { operationPollInterval = origPollInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	op, err := waitForOperation(ctx,
+		&compute.Operation{Name: "op-0", Status: "PENDING"}, time.Minute,
+		func(ctx context.Context, name string) (*compute.Operation, error) {
+			cancel()
+			return &compute.Operation{Name: name, Status: "RUNNING"}, nil
+		})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "RUNNING", op.Status)
+}
@@ -5,13 +5,56 @@ import "os"
 func init() {
 	for _, envVar := range []string{
 		"GCLOUD_CLEANUP_ACCOUNT_JSON",
+		"GCLOUD_CLEANUP_CONFIG",
+		"GCLOUD_CLEANUP_DELETE_CONCURRENCY",
+		"GCLOUD_CLEANUP_DISK_FILTERS",
+		"GCLOUD_CLEANUP_DISK_MAX_AGE",
+		"GCLOUD_CLEANUP_ENTITY_BACKOFF",
+		"GCLOUD_CLEANUP_ENTITY_MAX_BACKOFF",
+		"GCLOUD_CLEANUP_ENTITY_MAX_FAILURES",
+		"GCLOUD_CLEANUP_ENTITY_SCHEDULES",
+		"GCLOUD_CLEANUP_HEALTH_STALL_TIMEOUT",
+		"GCLOUD_CLEANUP_IMAGE_FILTERS",
+		"GCLOUD_CLEANUP_INSTANCE_EXPIRES_AT_LABEL",
 		"GCLOUD_CLEANUP_INSTANCE_FILTERS",
+		"GCLOUD_CLEANUP_INSTANCE_TTL_LABEL",
 		"GCLOUD_CLEANUP_JOB_BOARD_URL",
+		"GCLOUD_CLEANUP_LEADER_ELECTION",
+		"GCLOUD_CLEANUP_LEADER_ID",
+		"GCLOUD_CLEANUP_LEADER_LEASE_KEY",
+		"GCLOUD_CLEANUP_LEADER_LEASE_TTL",
+		"GCLOUD_CLEANUP_LIST_RETRY_BUDGET",
+		"GCLOUD_CLEANUP_OPERATION_TIMEOUT",
+		"GCLOUD_CLEANUP_PLAN",
+		"GCLOUD_CLEANUP_PLAN_FORMAT",
+		"GCLOUD_CLEANUP_PLAN_OUTPUT",
+		"GCLOUD_CLEANUP_PROJECT_FILTERS",
 		"GCLOUD_CLEANUP_PROJECT_ID",
+		"GCLOUD_CLEANUP_PROJECT_LABEL_SELECTOR",
+		"GCLOUD_CLEANUP_PROJECT_RATE_LIMIT_PREFIXES",
+		"GCLOUD_CLEANUP_PROMETHEUS_ADDR",
+		"GCLOUD_CLEANUP_PROTECTION_LABEL",
+		"GCLOUD_CLEANUP_RATE_LIMIT_ALGORITHM",
 		"GCLOUD_CLEANUP_RATE_LIMIT_DURATION",
 		"GCLOUD_CLEANUP_RATE_LIMIT_MAX_CALLS",
+		"GCLOUD_CLEANUP_RATE_LIMIT_MIN_FACTOR",
 		"GCLOUD_CLEANUP_RATE_LIMIT_PREFIX",
+		"GCLOUD_CLEANUP_RATE_LIMIT_RECOVERY",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_POOL_MAX_ACTIVE",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_POOL_MAX_IDLE",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_SENTINEL_ADDRS",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_SENTINEL_MASTER",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_TLS_CA_FILE",
+		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_TLS_SKIP_VERIFY",
 		"GCLOUD_CLEANUP_RATE_LIMIT_REDIS_URL",
+		"GCLOUD_CLEANUP_RATE_LIMITS",
+		"GCLOUD_CLEANUP_REGIONS",
+		"GCLOUD_CLEANUP_SCHEDULE_JITTER",
+		"GCLOUD_CLEANUP_SHUTDOWN_GRACE_PERIOD",
+		"GCLOUD_CLEANUP_SNAPSHOT_FILTERS",
+		"GCLOUD_CLEANUP_SNAPSHOT_KEEP_LAST",
+		"GCLOUD_CLEANUP_SNAPSHOT_MAX_AGE",
+		"GCLOUD_CLEANUP_STATUS_ADDR",
 		"GCLOUD_CLEANUP_ZONES",
 	} {
 		os.Unsetenv(envVar)
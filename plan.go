@@ -0,0 +1,147 @@
+package gcloudcleanup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	planFormatJSON  = "json"
+	planFormatTable = "table"
+)
+
+// planEntry describes a single resource that would be cleaned up.
+type planEntry struct {
+	Project string            `json:"project"`
+	Entity  string            `json:"entity"`
+	Name    string            `json:"name"`
+	Zone    string            `json:"zone,omitempty"`
+	Reason  string            `json:"reason"`
+	Rule    string            `json:"rule,omitempty"`
+	Action  string            `json:"action"`
+	Created string            `json:"created"`
+	Age     string            `json:"age"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// plan collects the resources the cleaners would clean up instead of acting
+// on them.
+type plan struct {
+	sync.Mutex
+
+	Entries []*planEntry `json:"entries"`
+}
+
+func newPlan() *plan {
+	return &plan{Entries: []*planEntry{}}
+}
+
+// add records a resource, computing its age relative to now. An empty action
+// means the resource would be deleted.
+func (p *plan) add(projectID, entity, name, zone, creationTimestamp, reason, rule, action string,
+	labels map[string]string, now time.Time) {
+
+	if action == "" {
+		action = policyActionDelete
+	}
+
+	entry := &planEntry{
+		Project: projectID,
+		Entity:  entity,
+		Name:    name,
+		Reason:  reason,
+		Rule:    rule,
+		Action:  action,
+		Created: creationTimestamp,
+		Labels:  labels,
+	}
+
+	if zone != "" {
+		entry.Zone = filepath.Base(zone)
+	}
+
+	ts, err := time.Parse(time.RFC3339, creationTimestamp)
+	if err == nil {
+		entry.Created = ts.UTC().Format(time.RFC3339)
+		entry.Age = now.Sub(ts).Truncate(time.Second).String()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.Entries = append(p.Entries, entry)
+}
+
+// sortedEntries returns the entries ordered by project, entity and name so
+// that plans of different runs can be diffed.
+func (p *plan) sortedEntries() []*planEntry {
+	p.Lock()
+	defer p.Unlock()
+
+	entries := append([]*planEntry{}, p.Entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Project != entries[j].Project {
+			return entries[i].Project < entries[j].Project
+		}
+		if entries[i].Entity != entries[j].Entity {
+			return entries[i].Entity < entries[j].Entity
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Write writes the plan in the given format.
+func (p *plan) Write(w io.Writer, format string) error {
+	switch format {
+	case planFormatJSON:
+		return p.writeJSON(w)
+	case planFormatTable, "":
+		return p.writeTable(w)
+	default:
+		return fmt.Errorf("unknown plan format %q", format)
+	}
+}
+
+func (p *plan) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"entries": p.sortedEntries()})
+}
+
+func (p *plan) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PROJECT\tENTITY\tNAME\tZONE\tACTION\tREASON\tRULE\tAGE\tLABELS")
+
+	for _, entry := range p.sortedEntries() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Project, entry.Entity, entry.Name, orDash(entry.Zone),
+			entry.Action, entry.Reason, orDash(entry.Rule), orDash(entry.Age),
+			orDash(formatLabels(entry.Labels)))
+	}
+
+	return tw.Flush()
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,68 @@
+package gcloudcleanup
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPlan() *plan {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	p := newPlan()
+	p.add("foo-project", "instances", "test-vm-1", "zones/us-central1-a",
+		"2018-06-01T09:00:00Z", "stale", "stale", "", map[string]string{"role": "worker", "env": "test"}, now)
+	p.add("foo-project", "images", "travis-ci-old", "",
+		"2018-05-01T12:00:00Z", "not-registered", "not-registered", policyActionDelete, nil, now)
+	p.add("foo-project", "instances", "test-vm-0", "zones/us-central1-b",
+		"2018-06-01T11:30:00Z", "TERMINATED", "TERMINATED", policyActionStop, nil, now)
+	return p
+}
+
+func TestPlan_Write_json(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := testPlan().Write(buf, planFormatJSON)
+	assert.Nil(t, err)
+
+	report := struct {
+		Entries []*planEntry `json:"entries"`
+	}{}
+	err = json.Unmarshal(buf.Bytes(), &report)
+	assert.Nil(t, err)
+
+	assert.Len(t, report.Entries, 3)
+	assert.Equal(t, "travis-ci-old", report.Entries[0].Name)
+	assert.Equal(t, "", report.Entries[0].Zone)
+	assert.Equal(t, "744h0m0s", report.Entries[0].Age)
+	assert.Equal(t, "test-vm-0", report.Entries[1].Name)
+	assert.Equal(t, policyActionStop, report.Entries[1].Action)
+	assert.Equal(t, "test-vm-1", report.Entries[2].Name)
+	assert.Equal(t, "us-central1-a", report.Entries[2].Zone)
+	assert.Equal(t, policyActionDelete, report.Entries[2].Action)
+	assert.Equal(t, "3h0m0s", report.Entries[2].Age)
+	assert.Equal(t, map[string]string{"role": "worker", "env": "test"}, report.Entries[2].Labels)
+}
+
+func TestPlan_Write_table(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := testPlan().Write(buf, planFormatTable)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, []string{"PROJECT", "ENTITY", "NAME", "ZONE", "ACTION", "REASON", "RULE", "AGE", "LABELS"},
+		strings.Fields(lines[0]))
+	assert.Equal(t, []string{"foo-project", "images", "travis-ci-old", "-", "delete", "not-registered", "not-registered", "744h0m0s", "-"},
+		strings.Fields(lines[1]))
+	assert.Equal(t, []string{"foo-project", "instances", "test-vm-1", "us-central1-a", "delete", "stale", "stale", "3h0m0s", "env=test,role=worker"},
+		strings.Fields(lines[3]))
+}
+
+func TestPlan_Write_unknownFormat(t *testing.T) {
+	err := testPlan().Write(&bytes.Buffer{}, "yaml")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,229 @@
+package gcloudcleanup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	policyActionDelete      = "delete"
+	policyActionStop        = "stop"
+	policyActionArchiveOnly = "archive-only"
+)
+
+// policy is the declarative cleanup configuration loaded from --config. Rules
+// are evaluated in order and the first matching rule wins.
+type policy struct {
+	Instances []*policyRule `yaml:"instances"`
+	Images    []*policyRule `yaml:"images"`
+}
+
+type policyRule struct {
+	Name   string `yaml:"name"`
+	Reason string `yaml:"reason"`
+
+	// Filter is a regular expression the resource name must match
+	Filter   string            `yaml:"filter"`
+	MaxAge   string            `yaml:"max_age"`
+	Statuses []string          `yaml:"statuses"`
+	Labels   map[string]string `yaml:"labels"`
+
+	// Unregistered only applies to images and matches images unknown to
+	// job-board
+	Unregistered bool `yaml:"unregistered"`
+
+	Action string `yaml:"action"`
+
+	filterRegexp *regexp.Regexp
+	maxAge       time.Duration
+}
+
+// defaultInstanceRules mirrors the behaviour of gcloud-cleanup without a
+// policy file.
+func defaultInstanceRules(maxAge time.Duration) []*policyRule {
+	return []*policyRule{
+		{Name: "stopped", Statuses: []string{"STOPPED"}, Action: policyActionDelete},
+		{Name: "TERMINATED", Statuses: []string{"TERMINATED"}, Action: policyActionDelete},
+		{Name: "stale", maxAge: maxAge, Action: policyActionDelete},
+	}
+}
+
+// defaultImageRules mirrors the behaviour of gcloud-cleanup without a policy
+// file.
+func defaultImageRules() []*policyRule {
+	return []*policyRule{
+		{Name: "not-registered", Unregistered: true, Action: policyActionDelete},
+	}
+}
+
+func loadPolicy(filename string) (*policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read policy file")
+	}
+
+	p := &policy{}
+	err = yaml.UnmarshalStrict(b, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse policy file")
+	}
+
+	err = p.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *policy) validate() error {
+	for entity, rules := range map[string][]*policyRule{
+		"instances": p.Instances,
+		"images":    p.Images,
+	} {
+		seen := map[string]bool{}
+
+		for i, rule := range rules {
+			if rule.Name == "" {
+				return fmt.Errorf("%s rule %d has no name", entity, i)
+			}
+			if seen[rule.Name] {
+				return fmt.Errorf("%s rule %q is defined more than once", entity, rule.Name)
+			}
+			seen[rule.Name] = true
+
+			err := rule.compile()
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s rule %q", entity, rule.Name)
+			}
+
+			if entity == "images" && rule.Action != policyActionDelete {
+				return fmt.Errorf("invalid images rule %q: action must be %q", rule.Name, policyActionDelete)
+			}
+			if entity == "instances" && rule.Unregistered {
+				return fmt.Errorf("invalid instances rule %q: unregistered only applies to images", rule.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pr *policyRule) compile() error {
+	if pr.Action == "" {
+		pr.Action = policyActionDelete
+	}
+
+	switch pr.Action {
+	case policyActionDelete, policyActionStop, policyActionArchiveOnly:
+	default:
+		return fmt.Errorf("unknown action %q", pr.Action)
+	}
+
+	if pr.Filter == "" && pr.MaxAge == "" && len(pr.Statuses) == 0 && len(pr.Labels) == 0 && !pr.Unregistered {
+		return fmt.Errorf("no filter, max_age, statuses, labels or unregistered given, so it would match everything")
+	}
+
+	if pr.Filter != "" {
+		re, err := regexp.Compile(pr.Filter)
+		if err != nil {
+			return errors.Wrap(err, "invalid filter")
+		}
+		pr.filterRegexp = re
+	}
+
+	if pr.MaxAge != "" {
+		maxAge, err := time.ParseDuration(pr.MaxAge)
+		if err != nil {
+			return errors.Wrap(err, "invalid max age")
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("max age must be positive")
+		}
+		pr.maxAge = maxAge
+	}
+
+	return nil
+}
+
+// reason returns the deletion reason reported for resources matching the
+// rule, which defaults to the rule name.
+func (pr *policyRule) reason() string {
+	if pr.Reason != "" {
+		return pr.Reason
+	}
+	return pr.Name
+}
+
+// matches checks everything but the age of a resource against the rule.
+func (pr *policyRule) matches(name, status string, labels map[string]string) bool {
+	if pr.filterRegexp != nil && !pr.filterRegexp.MatchString(name) {
+		return false
+	}
+
+	if len(pr.Statuses) > 0 {
+		found := false
+		for _, s := range pr.Statuses {
+			if s == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for key, value := range pr.Labels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// policyStore holds the current policy and allows swapping it on reload.
+type policyStore struct {
+	sync.RWMutex
+
+	filename string
+	policy   *policy
+}
+
+func newPolicyStore(filename string) (*policyStore, error) {
+	ps := &policyStore{filename: filename}
+	return ps, ps.Reload()
+}
+
+// Reload loads the policy file again. The current policy is kept if the file
+// is invalid.
+func (ps *policyStore) Reload() error {
+	p, err := loadPolicy(ps.filename)
+	if err != nil {
+		return err
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+	ps.policy = p
+	return nil
+}
+
+func (ps *policyStore) instanceRules() []*policyRule {
+	ps.RLock()
+	defer ps.RUnlock()
+	return ps.policy.Instances
+}
+
+func (ps *policyStore) imageRules() []*policyRule {
+	ps.RLock()
+	defer ps.RUnlock()
+	return ps.policy.Images
+}
@@ -0,0 +1,141 @@
+package gcloudcleanup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicyFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	assert.Nil(t, err)
+	return filename
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-cleanup-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := writePolicyFile(t, dir, "policy.yml", `
+instances:
+- name: debug-vms
+  filter: ^testing-gce-debug-
+  max_age: 72h
+  action: stop
+- name: smoke-tests
+  reason: stale
+  labels:
+    role: smoke-test
+  max_age: 10m
+- name: stopped
+  statuses: [STOPPED, TERMINATED]
+images:
+- name: not-registered
+  unregistered: true
+`)
+
+	p, err := loadPolicy(filename)
+	assert.Nil(t, err)
+	assert.Len(t, p.Instances, 3)
+	assert.Len(t, p.Images, 1)
+
+	assert.Equal(t, policyActionStop, p.Instances[0].Action)
+	assert.Equal(t, 72*time.Hour, p.Instances[0].maxAge)
+	assert.Equal(t, "debug-vms", p.Instances[0].reason())
+	assert.Equal(t, policyActionDelete, p.Instances[1].Action)
+	assert.Equal(t, "stale", p.Instances[1].reason())
+	assert.Equal(t, 10*time.Minute, p.Instances[1].maxAge)
+	assert.True(t, p.Images[0].Unregistered)
+
+	jsonFilename := writePolicyFile(t, dir, "policy.json", `{
+  "instances": [{"name": "terminated", "statuses": ["TERMINATED"], "action": "archive-only"}]
+}`)
+
+	p, err = loadPolicy(jsonFilename)
+	assert.Nil(t, err)
+	assert.Len(t, p.Instances, 1)
+	assert.Equal(t, policyActionArchiveOnly, p.Instances[0].Action)
+}
+
+func TestLoadPolicy_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-cleanup-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{
+		"instances:\n- statuses: [STOPPED]\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n- name: a\n  statuses: [STOPPED]\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  action: explode\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  max_age: forever\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  max_age: -1h\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  filter: '(['\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  unregistered: true\n",
+		"images:\n- name: a\n  unregistered: true\n  action: stop\n",
+		"instances:\n- name: a\n",
+		"instances:\n- name: a\n  reason: everything\n  action: stop\n",
+		"images:\n- name: a\n",
+		"instances:\n- name: a\n  statuses: [STOPPED]\n  colour: blue\n",
+	} {
+		_, err := loadPolicy(writePolicyFile(t, dir, "policy.yml", content))
+		assert.NotNil(t, err, content)
+	}
+
+	_, err = loadPolicy(filepath.Join(dir, "missing.yml"))
+	assert.NotNil(t, err)
+}
+
+func TestPolicyRule_matches(t *testing.T) {
+	pr := &policyRule{
+		Name:     "debug",
+		Filter:   "^testing-gce-debug-",
+		Statuses: []string{"RUNNING"},
+		Labels:   map[string]string{"role": "debug"},
+	}
+	assert.Nil(t, pr.compile())
+
+	assert.True(t, pr.matches("testing-gce-debug-1", "RUNNING", map[string]string{"role": "debug", "x": "y"}))
+	assert.False(t, pr.matches("testing-gce-1", "RUNNING", map[string]string{"role": "debug"}))
+	assert.False(t, pr.matches("testing-gce-debug-1", "STOPPED", map[string]string{"role": "debug"}))
+	assert.False(t, pr.matches("testing-gce-debug-1", "RUNNING", map[string]string{"role": "smoke"}))
+	assert.False(t, pr.matches("testing-gce-debug-1", "RUNNING", nil))
+
+	assert.True(t, (&policyRule{}).matches("anything", "ANY", nil))
+}
+
+func TestPolicyStore_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-cleanup-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := writePolicyFile(t, dir, "policy.yml", "instances:\n- name: a\n  statuses: [STOPPED]\n")
+
+	ps, err := newPolicyStore(filename)
+	assert.Nil(t, err)
+	assert.Len(t, ps.instanceRules(), 1)
+
+	writePolicyFile(t, dir, "policy.yml", "instances:\n- name: a\n  statuses: [STOPPED]\n- name: b\n  max_age: 3h\n")
+	assert.Nil(t, ps.Reload())
+	assert.Len(t, ps.instanceRules(), 2)
+
+	writePolicyFile(t, dir, "policy.yml", "instances:\n- name: a\n  statuses: [STOPPED]\n  action: explode\n")
+	assert.NotNil(t, ps.Reload())
+	assert.Len(t, ps.instanceRules(), 2)
+}
+
+func TestLoadPolicy_ruleWithoutConstraint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-cleanup-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = loadPolicy(writePolicyFile(t, dir, "policy.yml",
+		"instances:\n- name: stopped\n  statuses: [STOPPED]\n- name: oops\n  reason: typo\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `invalid instances rule "oops"`)
+	assert.Contains(t, err.Error(), "match everything")
+}
@@ -0,0 +1,143 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/travis-ci/gcloud-cleanup/metrics"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+// project holds the cleaners and per-project configuration for a single
+// Google Cloud project.
+type project struct {
+	id          string
+	log         *logrus.Entry
+	rateLimiter ratelimit.RateLimiter
+
+	// filters maps an entity name to filters overriding the global ones
+	filters map[string][]string
+
+	instanceCleaner *instanceCleaner
+	imageCleaner    *imageCleaner
+	diskCleaner     *diskCleaner
+	snapshotCleaner *snapshotCleaner
+}
+
+// filtersFor returns the per-project filter override for the given entity,
+// falling back to the given global filters.
+func (p *project) filtersFor(entity string, global []string) []string {
+	if filters, ok := p.filters[entity]; ok {
+		return filters
+	}
+	return global
+}
+
+// counts returns the counts of the last run of the given entity cleanup.
+func (p *project) counts(entity string) map[string]int64 {
+	switch {
+	case entity == "instances" && p.instanceCleaner != nil:
+		return p.instanceCleaner.lastCounts
+	case entity == "images" && p.imageCleaner != nil:
+		return p.imageCleaner.lastCounts
+	case entity == "disks" && p.diskCleaner != nil:
+		return p.diskCleaner.lastCounts
+	case entity == "snapshots" && p.snapshotCleaner != nil:
+		return p.snapshotCleaner.lastCounts
+	}
+	return nil
+}
+
+// projectLister resolves a label selector into a list of project ids.
+type projectLister interface {
+	ListProjects(ctx context.Context, labelSelector string) ([]string, error)
+}
+
+type resourceManagerProjectLister struct {
+	rms *cloudresourcemanager.Service
+}
+
+func (rmpl *resourceManagerProjectLister) ListProjects(ctx context.Context, labelSelector string) ([]string, error) {
+	projectIDs := []string{}
+
+	err := rmpl.rms.Projects.List().Filter(labelSelector).Pages(ctx,
+		func(resp *cloudresourcemanager.ListProjectsResponse) error {
+			for _, proj := range resp.Projects {
+				if proj.LifecycleState != "ACTIVE" {
+					continue
+				}
+				projectIDs = append(projectIDs, proj.ProjectId)
+			}
+			return nil
+		})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list projects")
+	}
+
+	sort.Strings(projectIDs)
+	return projectIDs, nil
+}
+
+// parseProjectFilters parses entries of the form
+// "<project>/<entity>=<filter>" into a map of project id to entity filters.
+func parseProjectFilters(entries []string) (map[string]map[string][]string, error) {
+	projectFilters := map[string]map[string][]string{}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid project filter %q", entry)
+		}
+
+		key := strings.SplitN(strings.TrimSpace(parts[0]), "/", 2)
+		if len(key) != 2 || key[0] == "" || key[1] == "" {
+			return nil, fmt.Errorf("invalid project filter %q", entry)
+		}
+
+		if _, ok := projectFilters[key[0]]; !ok {
+			projectFilters[key[0]] = map[string][]string{}
+		}
+
+		projectFilters[key[0]][key[1]] = append(projectFilters[key[0]][key[1]], strings.TrimSpace(parts[1]))
+	}
+
+	return projectFilters, nil
+}
+
+// parseProjectValues parses entries of the form "<project>=<value>" into a
+// map of project id to value.
+func parseProjectValues(entries []string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid project value %q", entry)
+		}
+
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return values, nil
+}
+
+// projectCounter increments the global counter for the given metric as well
+// as its per-project counterpart.
+func projectCounter(projectID, name string, value int64) {
+	metrics.Counter(fmt.Sprintf("travis.gcloud-cleanup.%s", name), value)
+	metrics.Counter(fmt.Sprintf("travis.gcloud-cleanup.projects.%s.%s", projectID, name), value)
+}
+
+// projectGauge updates the global gauge for the given metric as well as its
+// per-project counterpart.
+func projectGauge(projectID, name string, value int64) {
+	metrics.Gauge(fmt.Sprintf("travis.gcloud-cleanup.%s", name), value)
+	metrics.Gauge(fmt.Sprintf("travis.gcloud-cleanup.projects.%s.%s", projectID, name), value)
+}
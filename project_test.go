@@ -0,0 +1,125 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"gopkg.in/urfave/cli.v2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProjectLister struct {
+	projectIDs []string
+	err        error
+}
+
+func (fpl *fakeProjectLister) ListProjects(ctx context.Context, labelSelector string) ([]string, error) {
+	return fpl.projectIDs, fpl.err
+}
+
+func TestParseProjectFilters(t *testing.T) {
+	pf, err := parseProjectFilters([]string{
+		"foo-project/instances=name eq ^foo.*",
+		"foo-project/instances=status = RUNNING",
+		"bar-project/images=name eq ^bar.*",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string][]string{
+		"foo-project": {
+			"instances": {"name eq ^foo.*", "status = RUNNING"},
+		},
+		"bar-project": {
+			"images": {"name eq ^bar.*"},
+		},
+	}, pf)
+
+	_, err = parseProjectFilters([]string{"foo-project=name eq ^foo.*"})
+	assert.NotNil(t, err)
+}
+
+func TestParseProjectValues(t *testing.T) {
+	pv, err := parseProjectValues([]string{"foo-project=worker-foo", "bar-project = worker-bar"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"foo-project": "worker-foo",
+		"bar-project": "worker-bar",
+	}, pv)
+
+	_, err = parseProjectValues([]string{"foo-project"})
+	assert.NotNil(t, err)
+}
+
+func TestProject_filtersFor(t *testing.T) {
+	p := &project{
+		filters: map[string][]string{
+			"instances": {"name eq ^foo.*"},
+		},
+	}
+
+	assert.Equal(t, []string{"name eq ^foo.*"}, p.filtersFor("instances", []string{"name eq ^testing-gce.*"}))
+	assert.Equal(t, []string{"name eq ^travis-ci.*"}, p.filtersFor("images", []string{"name eq ^travis-ci.*"}))
+}
+
+func TestCLI_resolveProjects(t *testing.T) {
+	ranIt := false
+	app := &cli.App{
+		Flags: Flags,
+		Action: func(c *cli.Context) error {
+			gcccli := NewCLI(c)
+			gcccli.setupRateLimiter()
+			gcccli.projectIDs = c.StringSlice("project-id")
+			gcccli.projectLister = &fakeProjectLister{projectIDs: []string{"bar-project", "baz-project"}}
+
+			projects, err := gcccli.resolveProjects()
+			assert.Nil(t, err)
+			assert.Len(t, projects, 3)
+			assert.Equal(t, "foo-project", projects[0].id)
+			assert.Equal(t, "bar-project", projects[1].id)
+			assert.Equal(t, "baz-project", projects[2].id)
+
+			again, err := gcccli.resolveProjects()
+			assert.Nil(t, err)
+			assert.True(t, projects[0] == again[0])
+
+			ranIt = true
+			return nil
+		},
+	}
+	app.Run([]string{"foo", "--project-id", "foo-project", "--project-id", "bar-project"})
+	assert.True(t, ranIt)
+}
+
+func TestResourceManagerProjectLister_ListProjects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/projects", func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "labels.gcloud-cleanup:true", req.URL.Query().Get("filter"))
+		body := map[string]interface{}{
+			"projects": []interface{}{
+				map[string]string{"projectId": "foo-project", "lifecycleState": "ACTIVE"},
+				map[string]string{"projectId": "bar-project", "lifecycleState": "DELETE_REQUESTED"},
+				map[string]string{"projectId": "baz-project", "lifecycleState": "ACTIVE"},
+			},
+		}
+		err := json.NewEncoder(w).Encode(body)
+		assert.Nil(t, err)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	rms, err := cloudresourcemanager.New(&http.Client{})
+	assert.Nil(t, err)
+	rms.BasePath = srv.URL + "/"
+
+	rmpl := &resourceManagerProjectLister{rms: rms}
+	projectIDs, err := rmpl.ListProjects(context.Background(), "labels.gcloud-cleanup:true")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"baz-project", "foo-project"}, projectIDs)
+}
@@ -0,0 +1,39 @@
+package gcloudcleanup
+
+import "strings"
+
+// protectionLabel marks resources that must never be cleaned up. An empty
+// value matches any value of the label key.
+type protectionLabel struct {
+	key   string
+	value string
+}
+
+func parseProtectionLabel(s string) protectionLabel {
+	parts := strings.SplitN(strings.TrimSpace(s), "=", 2)
+	pl := protectionLabel{key: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		pl.value = strings.TrimSpace(parts[1])
+	}
+	return pl
+}
+
+func (pl protectionLabel) matches(labels map[string]string) bool {
+	if pl.key == "" {
+		return false
+	}
+
+	value, ok := labels[pl.key]
+	if !ok {
+		return false
+	}
+
+	return pl.value == "" || pl.value == value
+}
+
+func (pl protectionLabel) String() string {
+	if pl.value == "" {
+		return pl.key
+	}
+	return pl.key + "=" + pl.value
+}
@@ -0,0 +1,24 @@
+package gcloudcleanup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtectionLabel(t *testing.T) {
+	pl := parseProtectionLabel("gcloud-cleanup-protect=true")
+	assert.Equal(t, "gcloud-cleanup-protect=true", pl.String())
+	assert.True(t, pl.matches(map[string]string{"gcloud-cleanup-protect": "true"}))
+	assert.False(t, pl.matches(map[string]string{"gcloud-cleanup-protect": "false"}))
+	assert.False(t, pl.matches(map[string]string{}))
+	assert.False(t, pl.matches(nil))
+
+	pl = parseProtectionLabel("keep")
+	assert.Equal(t, "keep", pl.String())
+	assert.True(t, pl.matches(map[string]string{"keep": "forever"}))
+	assert.True(t, pl.matches(map[string]string{"keep": ""}))
+
+	pl = parseProtectionLabel("")
+	assert.False(t, pl.matches(map[string]string{"": ""}))
+}
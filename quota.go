@@ -0,0 +1,81 @@
+package gcloudcleanup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// quotaErrorTransport calls onQuotaError with the project and rate limit
+// bucket of every API call that fails with a quota error, so that the rate
+// limiter of that project can slow down calls in that bucket.
+type quotaErrorTransport struct {
+	base         http.RoundTripper
+	onQuotaError func(projectID, bucket string)
+}
+
+func (t *quotaErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusForbidden {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	apiErr := googleapi.CheckResponse(&http.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	})
+
+	if isQuotaError(apiErr) {
+		t.onQuotaError(projectFromPath(req.URL.Path), rateLimitBucketFromRequest(req))
+	}
+
+	return resp, nil
+}
+
+// projectFromPath returns the project of an API request path such as
+// /compute/v1/projects/<project>/zones/<zone>/instances, or an empty string
+// if there is none.
+func projectFromPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		if part == "projects" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// rateLimitBucketFromRequest returns the rate limit bucket the cleaners wait
+// on before making the given API request. Mutating calls, i.e. deletes and
+// instance stops, all wait on the delete bucket.
+func rateLimitBucketFromRequest(req *http.Request) string {
+	if req.Method != http.MethodGet {
+		return rateLimitBucketDelete
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, part := range parts {
+		if part == "serialPort" {
+			return rateLimitBucketSerialOutput
+		}
+		if part == "operations" && i+1 < len(parts) {
+			return rateLimitBucketOperations
+		}
+	}
+	return rateLimitBucketList
+}
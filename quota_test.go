@@ -0,0 +1,121 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/urfave/cli.v2"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+func TestQuotaErrorTransport(t *testing.T) {
+	for _, tc := range []struct {
+		status  int
+		body    string
+		project string
+	}{
+		{http.StatusOK, `{"items":[]}`, ""},
+		{http.StatusTooManyRequests, `{"error":{"code":429,"message":"slow down"}}`, "travis-ci-prod"},
+		{http.StatusForbidden, `{"error":{"code":403,"errors":[{"reason":"rateLimitExceeded"}]}}`, "travis-ci-prod"},
+		{http.StatusForbidden, `{"error":{"code":403,"errors":[{"reason":"forbidden"}]}}`, ""},
+		{http.StatusNotFound, `{"error":{"code":404}}`, ""},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		throttled := ""
+		client := &http.Client{}
+		withQuotaErrorTransport(client, func(projectID, bucket string) {
+			assert.Equal(t, rateLimitBucketList, bucket)
+			throttled = projectID
+		})
+
+		resp, err := client.Get(ts.URL + "/compute/v1/projects/travis-ci-prod/zones/us-central1-c/instances")
+		assert.Nil(t, err)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+
+		assert.Equal(t, tc.status, resp.StatusCode)
+		assert.Equal(t, tc.body, string(body))
+		assert.Equal(t, tc.project, throttled, "%d %s", tc.status, tc.body)
+
+		ts.Close()
+	}
+}
+
+func TestProjectFromPath(t *testing.T) {
+	assert.Equal(t, "foo", projectFromPath("/compute/v1/projects/foo/zones/us-central1-c/instances"))
+	assert.Equal(t, "foo", projectFromPath("/compute/v1/projects/foo"))
+	assert.Equal(t, "", projectFromPath("/compute/v1/projects"))
+	assert.Equal(t, "", projectFromPath("/batch"))
+}
+
+func TestRateLimitBucketFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		path   string
+		bucket string
+	}{
+		{"GET", "/compute/v1/projects/foo/aggregated/instances", rateLimitBucketList},
+		{"GET", "/compute/v1/projects/foo/global/images/travis-ci-0", rateLimitBucketList},
+		{"DELETE", "/compute/v1/projects/foo/zones/us-central1-c/instances/testing-gce-0", rateLimitBucketDelete},
+		{"POST", "/compute/v1/projects/foo/zones/us-central1-c/instances/testing-gce-0/stop", rateLimitBucketDelete},
+		{"GET", "/compute/v1/projects/foo/zones/us-central1-c/instances/testing-gce-0/serialPort", rateLimitBucketSerialOutput},
+		{"GET", "/compute/v1/projects/foo/zones/us-central1-c/operations/op-0", rateLimitBucketOperations},
+		{"GET", "/compute/v1/projects/foo/global/operations/op-0", rateLimitBucketOperations},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		assert.Equal(t, tc.bucket, rateLimitBucketFromRequest(req), "%s %s", tc.method, tc.path)
+	}
+}
+
+// maxCallsRateLimiter records the max calls it was last asked to let through
+// per name.
+type maxCallsRateLimiter struct {
+	maxCalls map[string]uint64
+}
+
+func (rl *maxCallsRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	rl.maxCalls[name] = maxCalls
+	return true, nil
+}
+
+func (rl *maxCallsRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	_, err := rl.RateLimit(name, maxCalls, per)
+	return err
+}
+
+func TestCLI_quotaErrorHandler(t *testing.T) {
+	rl := &maxCallsRateLimiter{maxCalls: map[string]uint64{}}
+
+	gcccli := NewCLI(&cli.Context{})
+	gcccli.log.Level = logrus.FatalLevel
+	gcccli.rateLimiter = ratelimit.NewAdaptiveRateLimiter(rl, nil, "",
+		ratelimit.AdaptiveConfig{MinFactor: 0.1, Recovery: time.Hour})
+
+	gcccli.quotaErrorHandler("foo-project", rateLimitBucketDelete)
+
+	for _, bucket := range rateLimitBuckets {
+		_, err := gcccli.rateLimiter.RateLimit(rateLimitName(bucket), 10, time.Second)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, map[string]uint64{
+		rateLimitName(rateLimitBucketList):         10,
+		rateLimitName(rateLimitBucketDelete):       5,
+		rateLimitName(rateLimitBucketSerialOutput): 10,
+		rateLimitName(rateLimitBucketOperations):   10,
+	}, rl.maxCalls)
+}
@@ -0,0 +1,96 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+// Buckets of GCE API calls, each rate limited independently so that e.g.
+// paging through serial output doesn't starve deletes.
+const (
+	rateLimitBucketList         = "list"
+	rateLimitBucketDelete       = "delete"
+	rateLimitBucketSerialOutput = "serial-output"
+	rateLimitBucketOperations   = "operations"
+)
+
+var rateLimitBuckets = []string{
+	rateLimitBucketList,
+	rateLimitBucketDelete,
+	rateLimitBucketSerialOutput,
+	rateLimitBucketOperations,
+}
+
+type rateLimit struct {
+	maxCalls uint64
+	per      time.Duration
+}
+
+// rateLimits holds the rate limit of each bucket of GCE API calls.
+type rateLimits map[string]rateLimit
+
+// defaultRateLimits returns rate limits with the same limit for every bucket.
+func defaultRateLimits(maxCalls uint64, per time.Duration) rateLimits {
+	limits := rateLimits{}
+	for _, bucket := range rateLimitBuckets {
+		limits[bucket] = rateLimit{maxCalls: maxCalls, per: per}
+	}
+	return limits
+}
+
+// wait blocks until rl lets through a call in the given bucket.
+func (rls rateLimits) wait(ctx context.Context, rl ratelimit.RateLimiter, bucket string) error {
+	limit := rls[bucket]
+	return rl.Wait(ctx, rateLimitName(bucket), limit.maxCalls, limit.per)
+}
+
+// rateLimitName returns the name under which calls in the given bucket are
+// rate limited and reported.
+func rateLimitName(bucket string) string {
+	return "gce-api-" + bucket
+}
+
+// parseRateLimits parses entries of the form "<bucket>=<max calls>/<duration>",
+// e.g. "delete=5/1s", on top of the given defaults.
+func parseRateLimits(entries []string, defaults rateLimits) (rateLimits, error) {
+	limits := rateLimits{}
+	for bucket, limit := range defaults {
+		limits[bucket] = limit
+	}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", entry)
+		}
+
+		bucket := strings.TrimSpace(parts[0])
+		if _, ok := defaults[bucket]; !ok {
+			return nil, fmt.Errorf("unknown rate limit bucket %q", bucket)
+		}
+
+		limitParts := strings.SplitN(strings.TrimSpace(parts[1]), "/", 2)
+		if len(limitParts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", entry)
+		}
+
+		maxCalls, err := strconv.ParseUint(limitParts[0], 10, 64)
+		if err != nil || maxCalls == 0 {
+			return nil, fmt.Errorf("invalid rate limit max calls in %q", entry)
+		}
+
+		per, err := time.ParseDuration(limitParts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit duration in %q", entry)
+		}
+
+		limits[bucket] = rateLimit{maxCalls: maxCalls, per: per}
+	}
+
+	return limits, nil
+}
@@ -0,0 +1,35 @@
+package gcloudcleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits([]string{"delete=5/1s", " serial-output = 2/500ms"}, defaultRateLimits(10, time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimits{
+		rateLimitBucketList:         {maxCalls: 10, per: time.Second},
+		rateLimitBucketDelete:       {maxCalls: 5, per: time.Second},
+		rateLimitBucketSerialOutput: {maxCalls: 2, per: 500 * time.Millisecond},
+		rateLimitBucketOperations:   {maxCalls: 10, per: time.Second},
+	}, limits)
+
+	for _, entry := range []string{
+		"delete",
+		"delete=5",
+		"insert=5/1s",
+		"delete=0/1s",
+		"delete=x/1s",
+		"delete=5/x",
+	} {
+		_, err := parseRateLimits([]string{entry}, defaultRateLimits(10, time.Second))
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestRateLimitName(t *testing.T) {
+	assert.Equal(t, "gce-api-serial-output", rateLimitName(rateLimitBucketSerialOutput))
+}
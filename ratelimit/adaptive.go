@@ -0,0 +1,280 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/travis-ci/gcloud-cleanup/metrics"
+)
+
+const (
+	// adaptiveDecrease is what the rate factor is multiplied with on a quota
+	// error
+	adaptiveDecrease = 0.5
+
+	// adaptiveCooldown is the minimum time between two decreases, so that a
+	// burst of quota errors from concurrent calls only counts once
+	adaptiveCooldown = 5 * time.Second
+
+	// adaptiveRefresh is how long a rate factor is cached before it is read
+	// from the store again
+	adaptiveRefresh = time.Second
+)
+
+// adaptiveScript applies the recovery since the last update to the rate
+// factor stored in a hash and, if asked to, decreases it, returning the new
+// factor. Once the factor has fully recovered the hash is removed.
+//
+// KEYS[1] is the key, ARGV[1] the current time in milliseconds, ARGV[2] "1"
+// to decrease the factor, ARGV[3] the min factor, ARGV[4] the recovery per
+// millisecond, ARGV[5] the cooldown in milliseconds and ARGV[6] the decrease
+// multiplier.
+var adaptiveScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local min = tonumber(ARGV[3])
+local recovery = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", KEYS[1], "factor", "updated", "decreased")
+local factor = tonumber(state[1]) or 1
+local updated = tonumber(state[2]) or now
+local decreased = tonumber(state[3]) or 0
+
+if now > updated then
+	factor = math.min(1, factor + (now - updated) * recovery)
+	updated = now
+end
+
+if ARGV[2] == "1" and now - decreased >= tonumber(ARGV[5]) then
+	factor = math.max(min, factor * tonumber(ARGV[6]))
+	decreased = now
+end
+
+if factor >= 1 then
+	redis.call("DEL", KEYS[1])
+	return "1"
+end
+
+redis.call("HMSET", KEYS[1],
+	"factor", tostring(factor),
+	"updated", string.format("%d", updated),
+	"decreased", string.format("%d", decreased))
+redis.call("PEXPIRE", KEYS[1], string.format("%d", math.ceil((1 - factor) / recovery) + 1))
+return tostring(factor)
+`)
+
+// AdaptiveRateLimiter is a RateLimiter that lets through fewer calls after
+// being told about quota errors, and gradually recovers afterwards.
+type AdaptiveRateLimiter interface {
+	RateLimiter
+
+	// Throttled reports a quota error for calls with the given name. The rate
+	// is halved, down to the configured min factor, unless it was already
+	// halved within the last few seconds. The new rate factor is returned.
+	Throttled(name string) (float64, error)
+}
+
+// AdaptiveConfig configures how an AdaptiveRateLimiter reacts to quota
+// errors.
+type AdaptiveConfig struct {
+	// MinFactor is the lowest fraction of max calls that is let through
+	MinFactor float64
+
+	// Recovery is how long it takes to recover from MinFactor to the full
+	// rate without further quota errors
+	Recovery time.Duration
+}
+
+// rateFactorStore keeps the fraction of max calls to let through per name.
+type rateFactorStore interface {
+	update(name string, now time.Time, decrease bool) (float64, error)
+}
+
+type cachedRateFactor struct {
+	factor  float64
+	fetched time.Time
+}
+
+type adaptiveRateLimiter struct {
+	rl    RateLimiter
+	store rateFactorStore
+
+	mutex   sync.Mutex
+	factors map[string]*cachedRateFactor
+
+	now func() time.Time
+}
+
+// NewAdaptiveRateLimiter wraps rl so that max calls is scaled down on quota
+// errors reported with Throttled. If a Redis pool is given, the rate factor is
+// shared through Redis under the given prefix, so that all processes using it
+// slow down together. Otherwise it is kept in memory.
+func NewAdaptiveRateLimiter(rl RateLimiter, pool *redis.Pool, prefix string, config AdaptiveConfig) AdaptiveRateLimiter {
+	var store rateFactorStore = newLocalRateFactorStore(config)
+	if pool != nil {
+		store = &redisRateFactorStore{
+			pool:   pool,
+			prefix: prefix,
+			config: config,
+		}
+	}
+
+	return &adaptiveRateLimiter{
+		rl:      rl,
+		store:   store,
+		factors: map[string]*cachedRateFactor{},
+		now:     time.Now,
+	}
+}
+
+func (arl *adaptiveRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	factor, err := arl.factor(name)
+	if err != nil {
+		return false, err
+	}
+
+	effective := effectiveMaxCalls(maxCalls, factor)
+	metrics.Gauge(fmt.Sprintf("travis.gcloud-cleanup.rate_limit.%s.effective_max_calls", name), int64(effective))
+
+	return arl.rl.RateLimit(name, effective, per)
+}
+
+func (arl *adaptiveRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, arl, name, maxCalls, per)
+}
+
+func (arl *adaptiveRateLimiter) Throttled(name string) (float64, error) {
+	now := arl.now()
+
+	factor, err := arl.store.update(name, now, true)
+	if err != nil {
+		return 0, err
+	}
+
+	arl.mutex.Lock()
+	arl.factors[name] = &cachedRateFactor{factor: factor, fetched: now}
+	arl.mutex.Unlock()
+
+	metrics.Mark(fmt.Sprintf("travis.gcloud-cleanup.rate_limit.%s.throttled", name))
+
+	return factor, nil
+}
+
+// factor returns the rate factor for the given name, reading it from the
+// store if the cached one is stale.
+func (arl *adaptiveRateLimiter) factor(name string) (float64, error) {
+	now := arl.now()
+
+	arl.mutex.Lock()
+	cached, ok := arl.factors[name]
+	arl.mutex.Unlock()
+
+	if ok && now.Sub(cached.fetched) < adaptiveRefresh {
+		return cached.factor, nil
+	}
+
+	factor, err := arl.store.update(name, now, false)
+	if err != nil {
+		return 0, err
+	}
+
+	arl.mutex.Lock()
+	arl.factors[name] = &cachedRateFactor{factor: factor, fetched: now}
+	arl.mutex.Unlock()
+
+	return factor, nil
+}
+
+// effectiveMaxCalls scales maxCalls by factor, letting through at least one
+// call.
+func effectiveMaxCalls(maxCalls uint64, factor float64) uint64 {
+	effective := uint64(math.Floor(float64(maxCalls) * factor))
+	if effective < 1 {
+		return 1
+	}
+	return effective
+}
+
+type redisRateFactorStore struct {
+	pool   *redis.Pool
+	prefix string
+	config AdaptiveConfig
+}
+
+func (s *redisRateFactorStore) update(name string, now time.Time, decrease bool) (float64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	decreaseArg := "0"
+	if decrease {
+		decreaseArg = "1"
+	}
+
+	key := fmt.Sprintf("%s:%s:adaptive", s.prefix, name)
+
+	return redis.Float64(adaptiveScript.Do(conn, key,
+		now.UnixNano()/int64(time.Millisecond),
+		decreaseArg,
+		strconv.FormatFloat(s.config.MinFactor, 'f', -1, 64),
+		strconv.FormatFloat(recoveryPerMillisecond(s.config), 'f', -1, 64),
+		int64(adaptiveCooldown/time.Millisecond),
+		strconv.FormatFloat(adaptiveDecrease, 'f', -1, 64)))
+}
+
+type localRateFactor struct {
+	factor    float64
+	updated   time.Time
+	decreased time.Time
+}
+
+type localRateFactorStore struct {
+	mutex   sync.Mutex
+	factors map[string]*localRateFactor
+	config  AdaptiveConfig
+}
+
+func newLocalRateFactorStore(config AdaptiveConfig) *localRateFactorStore {
+	return &localRateFactorStore{
+		factors: map[string]*localRateFactor{},
+		config:  config,
+	}
+}
+
+func (s *localRateFactorStore) update(name string, now time.Time, decrease bool) (float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, ok := s.factors[name]
+	if !ok {
+		f = &localRateFactor{factor: 1, updated: now}
+		s.factors[name] = f
+	}
+
+	if now.After(f.updated) {
+		elapsed := float64(now.Sub(f.updated) / time.Millisecond)
+		f.factor = math.Min(1, f.factor+elapsed*recoveryPerMillisecond(s.config))
+		f.updated = now
+	}
+
+	if decrease && now.Sub(f.decreased) >= adaptiveCooldown {
+		f.factor = math.Max(s.config.MinFactor, f.factor*adaptiveDecrease)
+		f.decreased = now
+	}
+
+	return f.factor, nil
+}
+
+// recoveryPerMillisecond returns how much the rate factor recovers per
+// millisecond.
+func recoveryPerMillisecond(config AdaptiveConfig) float64 {
+	recovery := float64(config.Recovery / time.Millisecond)
+	if recovery < 1 {
+		recovery = 1
+	}
+	return (1 - config.MinFactor) / recovery
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func testRateFactorStore(t *testing.T, store rateFactorStore) {
+	now := time.Now()
+
+	assertFactor := func(expected float64, now time.Time, decrease bool) {
+		t.Helper()
+
+		factor, err := store.update("gce-api", now, decrease)
+		if err != nil {
+			t.Fatalf("rate factor store error: %v", err)
+		}
+		if math.Abs(factor-expected) > 0.001 {
+			t.Fatalf("expected factor %v, got %v", expected, factor)
+		}
+	}
+
+	assertFactor(1, now, false)
+	assertFactor(0.5, now, true)
+
+	// recovers from 0.1 to 1 in 90s, so 0.01 per second, and decreases
+	// within the cooldown only count once
+	assertFactor(0.51, now.Add(time.Second), true)
+
+	assertFactor(0.275, now.Add(5*time.Second), true)
+	assertFactor(0.1625, now.Add(10*time.Second), true)
+	assertFactor(0.10625, now.Add(15*time.Second), true)
+	assertFactor(0.1, now.Add(20*time.Second), true)
+
+	assertFactor(0.2, now.Add(30*time.Second), false)
+	assertFactor(1, now.Add(20*time.Second+2*time.Minute), false)
+
+	// clocks going backwards don't recover anything
+	assertFactor(0.5, now.Add(200*time.Second), true)
+	assertFactor(0.5, now.Add(150*time.Second), false)
+}
+
+func TestLocalRateFactorStore(t *testing.T) {
+	testRateFactorStore(t, newLocalRateFactorStore(AdaptiveConfig{MinFactor: 0.1, Recovery: 90 * time.Second}))
+}
+
+func TestRedisRateFactorStore(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	testRateFactorStore(t, &redisRateFactorStore{
+		pool:   newTestRedisPool(t, "redis://"+mr.Addr()),
+		prefix: "test",
+		config: AdaptiveConfig{MinFactor: 0.1, Recovery: 90 * time.Second},
+	})
+}
+
+func TestAdaptiveRateLimiter(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	config := AdaptiveConfig{MinFactor: 0.1, Recovery: time.Minute}
+	now := time.Now()
+
+	arl := NewAdaptiveRateLimiter(NewTokenBucketRateLimiter(), newTestRedisPool(t, "redis://"+mr.Addr()), "test", config).(*adaptiveRateLimiter)
+	arl.now = func() time.Time { return now }
+
+	other := NewAdaptiveRateLimiter(NewNullRateLimiter(), newTestRedisPool(t, "redis://"+mr.Addr()), "test", config).(*adaptiveRateLimiter)
+	other.now = func() time.Time { return now }
+
+	factor, err := other.Throttled("gce-api")
+	if err != nil {
+		t.Fatalf("unexpected throttled error: %v", err)
+	}
+	if factor != 0.5 {
+		t.Fatalf("expected factor 0.5, got %v", factor)
+	}
+
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		ok, err := arl.RateLimit("gce-api", 10, time.Hour)
+		if err != nil {
+			t.Fatalf("rate limiter error: %v", err)
+		}
+		if ok {
+			admitted++
+		}
+	}
+
+	if admitted != 5 {
+		t.Fatalf("expected the rate reduced by another client to let through 5 calls, got %d", admitted)
+	}
+}
+
+func TestEffectiveMaxCalls(t *testing.T) {
+	for _, tc := range []struct {
+		maxCalls uint64
+		factor   float64
+		expected uint64
+	}{
+		{10, 1, 10},
+		{10, 0.55, 5},
+		{10, 0.01, 1},
+		{0, 1, 1},
+	} {
+		if actual := effectiveMaxCalls(tc.maxCalls, tc.factor); actual != tc.expected {
+			t.Errorf("expected %d max calls for %d * %v, got %d", tc.expected, tc.maxCalls, tc.factor, actual)
+		}
+	}
+}
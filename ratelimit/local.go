@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type tokenBucketRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+
+	now func() time.Time
+}
+
+// NewTokenBucketRateLimiter creates a RateLimiter that keeps a token bucket
+// per name in memory, so it only limits calls made by the current process. A
+// bucket holds up to maxCalls tokens and is refilled at a rate of maxCalls
+// per the given duration, and every call let through takes a token. It is
+// safe for concurrent use.
+func NewTokenBucketRateLimiter() RateLimiter {
+	return &tokenBucketRateLimiter{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+func (rl *tokenBucketRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+
+	b, ok := rl.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: float64(maxCalls), last: now}
+		rl.buckets[name] = b
+	}
+
+	if per > 0 && now.After(b.last) {
+		b.tokens += float64(maxCalls) * float64(now.Sub(b.last)) / float64(per)
+		if b.tokens > float64(maxCalls) {
+			b.tokens = float64(maxCalls)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, nil
+	}
+
+	b.tokens--
+	return true, nil
+}
+
+func (rl *tokenBucketRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := NewTokenBucketRateLimiter().(*tokenBucketRateLimiter)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, err := rl.RateLimit("slow", 2, time.Second)
+		if err != nil {
+			t.Fatalf("rate limiter error: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to not get rate limited, but was limited")
+		}
+	}
+
+	ok, _ := rl.RateLimit("slow", 2, time.Second)
+	if ok {
+		t.Fatal("expected to get rate limited, but was not limited")
+	}
+
+	ok, _ = rl.RateLimit("other", 2, time.Second)
+	if !ok {
+		t.Fatal("expected other name to not get rate limited, but was limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+
+	ok, _ = rl.RateLimit("slow", 2, time.Second)
+	if !ok {
+		t.Fatal("expected to not get rate limited after refill, but was limited")
+	}
+
+	ok, _ = rl.RateLimit("slow", 2, time.Second)
+	if ok {
+		t.Fatal("expected to get rate limited, but was not limited")
+	}
+
+	now = now.Add(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = rl.RateLimit("slow", 2, time.Second)
+		if ok != (i < 2) {
+			t.Fatalf("expected bucket to be capped at 2 tokens, call %d got %v", i, ok)
+		}
+	}
+}
+
+func TestTokenBucketRateLimiter_concurrent(t *testing.T) {
+	rl := NewTokenBucketRateLimiter()
+
+	var (
+		admitted int64
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				ok, _ := rl.RateLimit("concurrent", 25, time.Hour)
+				if ok {
+					atomic.AddInt64(&admitted, 1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if admitted != 25 {
+		t.Fatalf("expected 25 calls to be let through, got %d", admitted)
+	}
+}
@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fixedWindowScript increments the counter of the current window and sets its
+// expiry when the window is first seen, returning 1 if the call is within
+// the limit and 0 otherwise.
+//
+// KEYS[1] is the window key, ARGV[1] the max calls and ARGV[2] the window
+// length in milliseconds.
+var fixedWindowScript = redis.NewScript(1, `
+local current = redis.call("INCR", KEYS[1])
+if current == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if current > tonumber(ARGV[1]) then
+	return 0
+end
+return 1
+`)
+
+// gcraScript implements the generic cell rate algorithm. The key holds the
+// theoretical arrival time (TAT) of the next call, and a call is let through
+// if it does not arrive more than the burst tolerance before the TAT.
+//
+// KEYS[1] is the key, ARGV[1] the current time, ARGV[2] the emission interval
+// and ARGV[3] the burst tolerance, all in microseconds.
+var gcraScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+if now < tat - tolerance then
+	return 0
+end
+
+tat = tat + interval
+redis.call("SET", KEYS[1], string.format("%d", tat), "PX", string.format("%d", math.ceil((tat - now) / 1000)))
+return 1
+`)
+
+// slidingWindowScript keeps a sorted set of the calls let through within the
+// last window, scored by their time, and lets a call through if fewer than
+// max calls are in the set.
+//
+// KEYS[1] is the key, ARGV[1] the current time and ARGV[2] the window length,
+// both in microseconds, ARGV[3] the max calls and ARGV[4] a unique member for
+// the call.
+var slidingWindowScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", string.format("%d", now - window))
+
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[1], string.format("%d", math.ceil(window / 1000)))
+return 1
+`)
+
+type luaFixedWindowRateLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+type luaGCRARateLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+type luaSlidingWindowRateLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewFixedWindowRateLimiter creates a Redis-backed RateLimiter with the same
+// fixed window behaviour as NewRateLimiter, but which checks and counts each
+// call atomically in a single Lua script, so it never lets through more than
+// maxCalls calls per window regardless of the number of clients.
+func NewFixedWindowRateLimiter(pool *redis.Pool, prefix string) RateLimiter {
+	return &luaFixedWindowRateLimiter{
+		pool:   pool,
+		prefix: prefix,
+	}
+}
+
+// NewGCRARateLimiter creates a Redis-backed RateLimiter using the generic
+// cell rate algorithm in a single Lua script. Up to maxCalls calls are let
+// through in a burst, after which calls are spread evenly at a rate of
+// maxCalls per the given duration, avoiding the bursts at window edges of
+// the fixed window rate limiters.
+func NewGCRARateLimiter(pool *redis.Pool, prefix string) RateLimiter {
+	return &luaGCRARateLimiter{
+		pool:   pool,
+		prefix: prefix,
+	}
+}
+
+// NewSlidingWindowRateLimiter creates a Redis-backed RateLimiter that keeps a
+// log of the calls let through in a single Lua script. It never lets through
+// more than maxCalls calls within any window of the given duration, so
+// unlike the fixed window rate limiters it doesn't allow bursts of twice
+// maxCalls at window edges, and it supports windows down to a millisecond.
+func NewSlidingWindowRateLimiter(pool *redis.Pool, prefix string) RateLimiter {
+	return &luaSlidingWindowRateLimiter{
+		pool:   pool,
+		prefix: prefix,
+	}
+}
+
+func (rl *luaFixedWindowRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	conn := rl.pool.Get()
+	defer conn.Close()
+
+	perMillis := int64(per / time.Millisecond)
+	if perMillis < 1 {
+		perMillis = 1
+	}
+
+	nowMillis := time.Now().UnixNano() / int64(time.Millisecond)
+	timestamp := nowMillis - (nowMillis % perMillis)
+
+	key := fmt.Sprintf("%s:%s:%d", rl.prefix, name, timestamp)
+
+	ok, err := redis.Int(fixedWindowScript.Do(conn, key, maxCalls, perMillis))
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+func (rl *luaGCRARateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	conn := rl.pool.Get()
+	defer conn.Close()
+
+	if maxCalls == 0 {
+		return false, nil
+	}
+
+	interval := int64(per/time.Microsecond) / int64(maxCalls)
+	if interval < 1 {
+		interval = 1
+	}
+	tolerance := interval * int64(maxCalls-1)
+
+	key := fmt.Sprintf("%s:%s:gcra", rl.prefix, name)
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+
+	ok, err := redis.Int(gcraScript.Do(conn, key, now, interval, tolerance))
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+func (rl *luaSlidingWindowRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	conn := rl.pool.Get()
+	defer conn.Close()
+
+	if per < time.Millisecond {
+		return false, fmt.Errorf("rate limit duration %v is shorter than a millisecond", per)
+	}
+
+	key := fmt.Sprintf("%s:%s:sliding", rl.prefix, name)
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+
+	ok, err := redis.Int(slidingWindowScript.Do(conn, key, now, int64(per/time.Microsecond), maxCalls, member))
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+func (rl *luaFixedWindowRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
+
+func (rl *luaGCRARateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
+
+func (rl *luaSlidingWindowRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
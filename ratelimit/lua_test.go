@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	return mr
+}
+
+func newTestRedisPool(t *testing.T, redisURL string) *redis.Pool {
+	pool, err := NewRedisPool(RedisConfig{URL: redisURL})
+	if err != nil {
+		t.Fatalf("could not create redis pool: %v", err)
+	}
+	return pool
+}
+
+// admitConcurrently lets clients rate limiters, each with its own connection
+// pool, try calls times each at the same time and returns how many calls were
+// let through.
+func admitConcurrently(t *testing.T, newRateLimiter func() RateLimiter, clients, calls int, maxCalls uint64, per time.Duration) int64 {
+	var (
+		admitted int64
+		wg       sync.WaitGroup
+	)
+
+	start := make(chan struct{})
+
+	for i := 0; i < clients; i++ {
+		rl := newRateLimiter()
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			<-start
+
+			for j := 0; j < calls; j++ {
+				ok, err := rl.RateLimit("concurrent", maxCalls, per)
+				if err != nil {
+					t.Errorf("rate limiter error: %v", err)
+					return
+				}
+				if ok {
+					atomic.AddInt64(&admitted, 1)
+				}
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	return admitted
+}
+
+func TestFixedWindowRateLimiter(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	rl := NewFixedWindowRateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+
+	for i := 0; i < 2; i++ {
+		ok, err := rl.RateLimit("slow", 2, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("rate limiter error: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to not get rate limited, but was limited")
+		}
+	}
+
+	ok, err := rl.RateLimit("slow", 2, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("rate limiter error: %v", err)
+	}
+	if ok {
+		t.Fatal("expected to get rate limited, but was not limited")
+	}
+
+	for _, key := range mr.Keys() {
+		if mr.TTL(key) <= 0 {
+			t.Fatalf("expected key %s to expire", key)
+		}
+	}
+}
+
+func TestFixedWindowRateLimiter_concurrentClients(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	admitted := admitConcurrently(t, func() RateLimiter {
+		return NewFixedWindowRateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+	}, 20, 10, 25, 24*time.Hour)
+
+	if admitted != 25 {
+		t.Fatalf("expected 25 calls to be let through, got %d", admitted)
+	}
+}
+
+func TestGCRARateLimiter(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	rl := NewGCRARateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+
+	for i := 0; i < 3; i++ {
+		ok, err := rl.RateLimit("fast", 3, 300*time.Millisecond)
+		if err != nil {
+			t.Fatalf("rate limiter error: %v", err)
+		}
+		if !ok {
+			t.Fatalf("expected burst call %d to not get rate limited, but was limited", i)
+		}
+	}
+
+	ok, err := rl.RateLimit("fast", 3, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("rate limiter error: %v", err)
+	}
+	if ok {
+		t.Fatal("expected to get rate limited, but was not limited")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	ok, err = rl.RateLimit("fast", 3, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("rate limiter error: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to not get rate limited after one interval, but was limited")
+	}
+}
+
+func TestGCRARateLimiter_concurrentClients(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	admitted := admitConcurrently(t, func() RateLimiter {
+		return NewGCRARateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+	}, 20, 10, 25, time.Hour)
+
+	if admitted != 25 {
+		t.Fatalf("expected 25 calls to be let through, got %d", admitted)
+	}
+}
+
+func TestSlidingWindowRateLimiter(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	rl := NewSlidingWindowRateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+
+	for i := 0; i < 2; i++ {
+		ok, err := rl.RateLimit("fast", 2, 200*time.Millisecond)
+		if err != nil {
+			t.Fatalf("rate limiter error: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to not get rate limited, but was limited")
+		}
+	}
+
+	ok, err := rl.RateLimit("fast", 2, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("rate limiter error: %v", err)
+	}
+	if ok {
+		t.Fatal("expected to get rate limited, but was not limited")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	ok, err = rl.RateLimit("fast", 2, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("rate limiter error: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to not get rate limited after the window, but was limited")
+	}
+
+	_, err = rl.RateLimit("fast", 2, time.Microsecond)
+	if err == nil {
+		t.Fatal("expected an error for a duration shorter than a millisecond")
+	}
+}
+
+func TestSlidingWindowRateLimiter_concurrentClients(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	admitted := admitConcurrently(t, func() RateLimiter {
+		return NewSlidingWindowRateLimiter(newTestRedisPool(t, "redis://"+mr.Addr()), "test")
+	}, 20, 10, 25, time.Hour)
+
+	if admitted != 25 {
+		t.Fatalf("expected 25 calls to be let through, got %d", admitted)
+	}
+}
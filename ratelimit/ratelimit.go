@@ -2,18 +2,13 @@
 package ratelimit
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
-const (
-	redisRateLimiterPoolMaxActive   = 1
-	redisRateLimiterPoolMaxIdle     = 1
-	redisRateLimiterPoolIdleTimeout = 3 * time.Minute
-)
-
 type RateLimiter interface {
 	// RateLimit checks if a call can be let through and returns true if it can.
 	//
@@ -32,6 +27,14 @@ type RateLimiter interface {
 	//
 	// In case an error happens, (false, err) is returned.
 	RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error)
+
+	// Wait blocks until a call can be let through, with the same arguments as
+	// RateLimit. Instead of polling, it sleeps until the rate limiter may let
+	// through the next call.
+	//
+	// An error is returned if the context is done before that, or if the rate
+	// limiter keeps erroring.
+	Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error
 }
 
 type redisRateLimiter struct {
@@ -41,24 +44,12 @@ type redisRateLimiter struct {
 
 type nullRateLimiter struct{}
 
-// NewRateLimiter creates a RateLimiter that's backed by Redis. The prefix can
-// be used to allow multiple rate limiters with the same name on the same Redis
-// server.
-func NewRateLimiter(redisURL string, prefix string) RateLimiter {
+// NewRateLimiter creates a RateLimiter that's backed by Redis, using a pool
+// created with NewRedisPool. The prefix can be used to allow multiple rate
+// limiters with the same name on the same Redis server.
+func NewRateLimiter(pool *redis.Pool, prefix string) RateLimiter {
 	return &redisRateLimiter{
-		pool: &redis.Pool{
-			Dial: func() (redis.Conn, error) {
-				return redis.DialURL(redisURL)
-			},
-			TestOnBorrow: func(c redis.Conn, _ time.Time) error {
-				_, err := c.Do("PING")
-				return err
-			},
-			MaxIdle:     redisRateLimiterPoolMaxIdle,
-			MaxActive:   redisRateLimiterPoolMaxActive,
-			IdleTimeout: redisRateLimiterPoolIdleTimeout,
-			Wait:        true,
-		},
+		pool:   pool,
 		prefix: prefix,
 	}
 }
@@ -71,9 +62,15 @@ func NewNullRateLimiter() RateLimiter {
 
 // BUG(sarahhodne): The Redis rate limiter is known to let through too many
 // requests when there are many clients talking to the same Redis. The reason
-// for this is unknown, but it's probably wise to limit the number of clients
-// to 5 or 6 for the time being.
+// for this is that the current count is read before the key is watched, so
+// concurrent clients may all see room for one more call. Use
+// NewFixedWindowRateLimiter or NewGCRARateLimiter instead, which check and
+// count atomically.
 func (rl *redisRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	if per < time.Second {
+		return false, fmt.Errorf("rate limit duration %v is shorter than a second", per)
+	}
+
 	conn := rl.pool.Get()
 	defer conn.Close()
 
@@ -123,3 +120,11 @@ func (rl *redisRateLimiter) RateLimit(name string, maxCalls uint64, per time.Dur
 func (rl nullRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
 	return true, nil
 }
+
+func (rl *redisRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
+
+func (rl nullRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return ctx.Err()
+}
@@ -16,7 +16,7 @@ func TestRateLimit(t *testing.T) {
 		t.Log("Note: The TestRateLimit test is known to have a bug if run near the top of the hour. Since the rate limiter isn't a moving window, it could end up checking against two different buckets on either side of the top of the hour, so if you see that just re-run it after you've passed the top of the hour.")
 	}
 
-	rateLimiter := NewRateLimiter(os.Getenv("REDIS_URL"), fmt.Sprintf("worker-test-rl-%d", os.Getpid()))
+	rateLimiter := NewRateLimiter(newTestRedisPool(t, os.Getenv("REDIS_URL")), fmt.Sprintf("worker-test-rl-%d", os.Getpid()))
 
 	ok, err := rateLimiter.RateLimit("slow", 2, time.Hour)
 	if err != nil {
@@ -42,3 +42,12 @@ func TestRateLimit(t *testing.T) {
 		t.Fatal("expected to get rate limited, but was not limited")
 	}
 }
+
+func TestRateLimit_subSecondDuration(t *testing.T) {
+	rl := NewRateLimiter(newTestRedisPool(t, "redis://127.0.0.1:0"), "test")
+
+	_, err := rl.RateLimit("fast", 2, 500*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected an error for a duration shorter than a second")
+	}
+}
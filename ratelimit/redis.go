@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisPoolDefaultMaxActive = 10
+	redisPoolDefaultMaxIdle   = 5
+	redisPoolIdleTimeout      = 3 * time.Minute
+	redisDialTimeout          = 5 * time.Second
+)
+
+// RedisConfig configures how the Redis-backed rate limiters connect to Redis.
+type RedisConfig struct {
+	// URL is the redis:// or rediss:// URL of the Redis server. With Sentinel,
+	// its host is replaced by the address of the current master.
+	URL string
+
+	// SentinelAddrs are the addresses of the Sentinels to ask for the address
+	// of the master named SentinelMaster. Sentinel is not used if empty.
+	SentinelAddrs  []string
+	SentinelMaster string
+
+	// TLSCAFile is a PEM file with the CAs to verify the server certificate
+	// with instead of the system ones, for rediss:// URLs
+	TLSCAFile string
+
+	// TLSSkipVerify disables verifying the server certificate, which is only
+	// meant for local testing
+	TLSSkipVerify bool
+
+	// PoolMaxActive is the max number of connections open at once, and
+	// PoolMaxIdle the max number of idle connections kept open. Defaults are
+	// used if they are zero.
+	PoolMaxActive int
+	PoolMaxIdle   int
+}
+
+// NewRedisPool creates a pool of connections to Redis to be shared by the
+// Redis-backed rate limiters. With Sentinel, the master is looked up every
+// time a connection is dialed, and idle connections are checked to still be
+// talking to the master when borrowed, so that the pool follows failovers.
+// Redis Cluster is not supported.
+func NewRedisPool(config RedisConfig) (*redis.Pool, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(redisDialTimeout),
+	}
+
+	if config.TLSCAFile != "" || config.TLSSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.TLSSkipVerify}
+
+		if config.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(config.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", config.TLSCAFile)
+			}
+		}
+
+		options = append(options, redis.DialTLSConfig(tlsConfig))
+	}
+
+	// DialURL appends to the options, so make sure concurrent dials don't
+	// share a backing array with room to spare
+	options = options[:len(options):len(options)]
+
+	maxActive := config.PoolMaxActive
+	if maxActive == 0 {
+		maxActive = redisPoolDefaultMaxActive
+	}
+	maxIdle := config.PoolMaxIdle
+	if maxIdle == 0 {
+		maxIdle = redisPoolDefaultMaxIdle
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(config.URL, options...)
+		},
+		TestOnBorrow: func(c redis.Conn, _ time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: redisPoolIdleTimeout,
+		Wait:        true,
+	}
+
+	if len(config.SentinelAddrs) > 0 {
+		// sentinels are dialed the same way as the master
+		sentinelOptions := append(options, redis.DialUseTLS(u.Scheme == "rediss"))
+
+		pool.Dial = func() (redis.Conn, error) {
+			addr, err := sentinelMasterAddr(config.SentinelAddrs, config.SentinelMaster, sentinelOptions)
+			if err != nil {
+				return nil, err
+			}
+
+			masterURL := *u
+			masterURL.Host = addr
+			return redis.DialURL(masterURL.String(), options...)
+		}
+		pool.TestOnBorrow = func(c redis.Conn, _ time.Time) error {
+			return checkMasterRole(c)
+		}
+	}
+
+	return pool, nil
+}
+
+// sentinelMasterAddr asks the given Sentinels in turn for the address of the
+// named master, returning the first answer.
+func sentinelMasterAddr(sentinelAddrs []string, master string, options []redis.DialOption) (string, error) {
+	var lastErr error
+
+	for _, sentinelAddr := range sentinelAddrs {
+		addr, err := askSentinel(sentinelAddr, master, options)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("no sentinel knows the address of master %q: %v", master, lastErr)
+}
+
+func askSentinel(sentinelAddr string, master string, options []redis.DialOption) (string, error) {
+	conn, err := redis.Dial("tcp", sentinelAddr, options...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", master))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected sentinel reply %q", reply)
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// checkMasterRole returns an error unless the connection is talking to a
+// master, e.g. because it was demoted to a replica by a failover.
+func checkMasterRole(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return fmt.Errorf("empty role reply")
+	}
+
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("connected to a %s instead of the master", role)
+	}
+
+	return nil
+}
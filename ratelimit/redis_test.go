@@ -0,0 +1,208 @@
+package ratelimit
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// runFakeSentinel answers every command with the given master address, like
+// a Sentinel answers SENTINEL get-master-addr-by-name. It returns the address
+// it listens on and the commands it received.
+func runFakeSentinel(t *testing.T, masterAddr string) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(masterAddr)
+	commands := make(chan []string, 10)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line)[1:])
+
+					args := []string{}
+					for i := 0; i < n; i++ {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						args = append(args, strings.TrimSpace(arg))
+					}
+					commands <- args
+
+					fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+				}
+			}(conn)
+		}
+	}()
+
+	t.Cleanup(func() { l.Close() })
+
+	return l.Addr().String(), commands
+}
+
+func TestNewRedisPool_sentinel(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+
+	sentinelAddr, commands := runFakeSentinel(t, mr.Addr())
+
+	pool, err := NewRedisPool(RedisConfig{
+		URL:            "redis://unused.example.com:6379",
+		SentinelAddrs:  []string{"127.0.0.1:1", sentinelAddr},
+		SentinelMaster: "mymaster",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if value, _ := mr.Get("foo"); value != "bar" {
+		t.Fatalf("expected the master to be written to, got %q", value)
+	}
+
+	select {
+	case args := <-commands:
+		if strings.Join(args, " ") != "SENTINEL get-master-addr-by-name mymaster" {
+			t.Fatalf("unexpected sentinel command %q", args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the sentinel to be asked for the master")
+	}
+}
+
+func TestNewRedisPool_sentinelUnavailable(t *testing.T) {
+	pool, err := NewRedisPool(RedisConfig{
+		URL:            "redis://",
+		SentinelAddrs:  []string{"127.0.0.1:1"},
+		SentinelMaster: "mymaster",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err == nil {
+		t.Fatal("expected an error without any sentinel")
+	}
+}
+
+func TestNewRedisPool_poolSize(t *testing.T) {
+	pool, err := NewRedisPool(RedisConfig{URL: "redis://"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pool.MaxActive != redisPoolDefaultMaxActive || pool.MaxIdle != redisPoolDefaultMaxIdle {
+		t.Fatalf("expected default pool size, got %d active and %d idle", pool.MaxActive, pool.MaxIdle)
+	}
+
+	pool, err = NewRedisPool(RedisConfig{URL: "redis://", PoolMaxActive: 20, PoolMaxIdle: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pool.MaxActive != 20 || pool.MaxIdle != 3 {
+		t.Fatalf("expected configured pool size, got %d active and %d idle", pool.MaxActive, pool.MaxIdle)
+	}
+}
+
+func TestNewRedisPool_tlsCAFile(t *testing.T) {
+	_, err := NewRedisPool(RedisConfig{URL: "rediss://", TLSCAFile: "/does/not/exist.pem"})
+	if err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	_, err = NewRedisPool(RedisConfig{URL: "rediss://", TLSCAFile: f.Name()})
+	if err == nil {
+		t.Fatal("expected an error for a CA file without certificates")
+	}
+}
+
+func TestNewRedisPool_tls(t *testing.T) {
+	// borrow the certificate of a TLS test server, which is valid for
+	// 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	mr, err := miniredis.RunTLS(&tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("could not start miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	f.Close()
+
+	for _, config := range []RedisConfig{
+		{URL: "rediss://" + mr.Addr(), TLSCAFile: f.Name()},
+		{URL: "rediss://" + mr.Addr(), TLSSkipVerify: true},
+	} {
+		pool, err := NewRedisPool(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		conn := pool.Get()
+		if _, err := conn.Do("PING"); err != nil {
+			t.Fatalf("unexpected error for %+v: %v", config, err)
+		}
+		conn.Close()
+	}
+
+	pool, err := NewRedisPool(RedisConfig{URL: "rediss://" + mr.Addr()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err == nil {
+		t.Fatal("expected an error for an unknown CA")
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/travis-ci/gcloud-cleanup/metrics"
+)
+
+// waitMaxErrors is the number of consecutive rate limiter errors after which
+// Wait gives up.
+const waitMaxErrors = 5
+
+// wait blocks until rl lets a call through, ctx is done or rl errored
+// waitMaxErrors times in a row. Admitted and denied calls and the time spent
+// waiting are reported per name.
+func wait(ctx context.Context, rl RateLimiter, name string, maxCalls uint64, per time.Duration) error {
+	ctx, span := trace.StartSpan(ctx, "RateLimitWait")
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("name", name),
+	)
+
+	start := time.Now()
+	defer metrics.RateLimitWait(name, start)
+
+	errCount := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ok, err := rl.RateLimit(name, maxCalls, per)
+		if err != nil {
+			errCount++
+			if errCount >= waitMaxErrors {
+				return err
+			}
+		} else {
+			errCount = 0
+		}
+		if ok {
+			metrics.RateLimitAdmitted(name)
+			return nil
+		}
+		if err == nil {
+			metrics.RateLimitDenied(name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nextCallDelay(time.Now(), maxCalls, per)):
+		}
+	}
+}
+
+// nextCallDelay returns how long to wait before asking the rate limiter
+// again. That is until the next fixed window starts, but no longer than the
+// average interval between calls, after which the sliding window, GCRA and
+// token bucket rate limiters let through the next call. Up to 10% of jitter
+// is added so that waiting clients don't all ask at once.
+func nextCallDelay(now time.Time, maxCalls uint64, per time.Duration) time.Duration {
+	if per <= 0 {
+		return time.Millisecond
+	}
+
+	delay := per - time.Duration(now.UnixNano()%int64(per))
+	if maxCalls > 0 {
+		if interval := per / time.Duration(maxCalls); interval < delay {
+			delay = interval
+		}
+	}
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
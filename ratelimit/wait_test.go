@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type erroringRateLimiter struct {
+	calls int
+}
+
+func (rl *erroringRateLimiter) RateLimit(name string, maxCalls uint64, per time.Duration) (bool, error) {
+	rl.calls++
+	return false, errors.New("no redis")
+}
+
+func (rl *erroringRateLimiter) Wait(ctx context.Context, name string, maxCalls uint64, per time.Duration) error {
+	return wait(ctx, rl, name, maxCalls, per)
+}
+
+func TestWait(t *testing.T) {
+	rl := NewTokenBucketRateLimiter()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := rl.Wait(context.Background(), "wait", 2, 100*time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected wait error: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("expected third call to wait about 50ms, waited %v", elapsed)
+	}
+}
+
+func TestWait_cancelled(t *testing.T) {
+	rl := NewTokenBucketRateLimiter()
+
+	ok, _ := rl.RateLimit("cancelled", 1, time.Hour)
+	if !ok {
+		t.Fatal("expected first call to not get rate limited")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := rl.Wait(ctx, "cancelled", 1, time.Hour)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected wait to return on cancellation, waited %v", elapsed)
+	}
+
+	if NewNullRateLimiter().Wait(ctx, "cancelled", 1, time.Hour) != context.DeadlineExceeded {
+		t.Fatal("expected null rate limiter to respect cancellation")
+	}
+}
+
+func TestWait_errors(t *testing.T) {
+	rl := &erroringRateLimiter{}
+
+	err := rl.Wait(context.Background(), "errors", 1000, time.Second)
+	if err == nil || err.Error() != "no redis" {
+		t.Fatalf("expected rate limiter error, got %v", err)
+	}
+	if rl.calls != waitMaxErrors {
+		t.Fatalf("expected %d calls, got %d", waitMaxErrors, rl.calls)
+	}
+}
+
+func TestNextCallDelay(t *testing.T) {
+	now := time.Unix(1000, 250*int64(time.Millisecond))
+
+	delay := nextCallDelay(now, 1, time.Second)
+	if delay < 750*time.Millisecond || delay > 825*time.Millisecond {
+		t.Fatalf("expected delay until next window, got %v", delay)
+	}
+
+	delay = nextCallDelay(now, 10, time.Second)
+	if delay < 100*time.Millisecond || delay > 110*time.Millisecond {
+		t.Fatalf("expected delay of one call interval, got %v", delay)
+	}
+
+	delay = nextCallDelay(now, 10000, time.Second)
+	if delay < time.Millisecond {
+		t.Fatalf("expected delay of at least a millisecond, got %v", delay)
+	}
+}
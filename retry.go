@@ -0,0 +1,121 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+var listRetryInitialInterval = time.Second
+
+// isRetryableError reports whether a failed API call may succeed when tried
+// again. Rate limiting and server side errors are retryable, as are errors
+// that did not come from the API at all (e.g. network errors). Anything else,
+// such as missing permissions or an unknown project, is permanent.
+func isRetryableError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return true
+	}
+
+	if isQuotaError(err) {
+		return true
+	}
+
+	switch gerr.Code {
+	case http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// isQuotaError reports whether a failed API call was rejected because too
+// many calls were made.
+func isQuotaError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	switch gerr.Code {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		for _, item := range gerr.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isNotFoundError reports whether a failed API call was about a resource that
+// doesn't exist.
+func isNotFoundError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusNotFound
+}
+
+// retryListCall calls f until it succeeds, fails with a permanent error, ctx
+// is done or budget has elapsed, and returns the last error. A budget of zero
+// disables retries.
+func retryListCall(ctx context.Context, log *logrus.Entry, budget time.Duration, f func() error) error {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = listRetryInitialInterval
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = budget
+
+	var bo backoff.BackOff = b
+	if budget <= 0 {
+		bo = &backoff.StopBackOff{}
+	}
+
+	return backoff.RetryNotify(func() error {
+		err := f()
+		if err != nil && !isRetryableError(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(bo, ctx), func(err error, next time.Duration) {
+		log.WithFields(logrus.Fields{
+			"err":      err,
+			"retry_in": next,
+		}).Warn("list call failed, retrying")
+	})
+}
+
+// collectFetchErrors logs every error received on errChan and, once errChan
+// is closed, sends the first of them (or nil) on the returned channel.
+func collectFetchErrors(log *logrus.Entry, msg string, errChan <-chan error) <-chan error {
+	fetchErrChan := make(chan error, 1)
+
+	go func() {
+		var fetchErr error
+
+		for err := range errChan {
+			if err == nil {
+				continue
+			}
+
+			log.WithField("err", err).Error(msg)
+
+			if fetchErr == nil {
+				fetchErr = err
+			}
+		}
+
+		fetchErrChan <- fetchErr
+	}()
+
+	return fetchErrChan
+}
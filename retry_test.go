@@ -0,0 +1,102 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func init() {
+	listRetryInitialInterval = time.Millisecond
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: errors.New("connection reset by peer"), retryable: true},
+		{err: &googleapi.Error{Code: http.StatusTooManyRequests}, retryable: true},
+		{err: &googleapi.Error{Code: http.StatusInternalServerError}, retryable: true},
+		{err: &googleapi.Error{Code: http.StatusServiceUnavailable}, retryable: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, retryable: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, retryable: false},
+		{err: &googleapi.Error{Code: http.StatusNotFound}, retryable: false},
+		{err: &googleapi.Error{Code: http.StatusBadRequest}, retryable: false},
+	} {
+		assert.Equal(t, tc.retryable, isRetryableError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestIsQuotaError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		quota bool
+	}{
+		{err: errors.New("connection reset by peer"), quota: false},
+		{err: &googleapi.Error{Code: http.StatusTooManyRequests}, quota: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, quota: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, quota: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, quota: false},
+		{err: &googleapi.Error{Code: http.StatusServiceUnavailable}, quota: false},
+	} {
+		assert.Equal(t, tc.quota, isQuotaError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestRetryListCall(t *testing.T) {
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	calls := 0
+	err := retryListCall(context.Background(), log.WithField("test", "yep"), time.Second, func() error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryListCall_permanent(t *testing.T) {
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	calls := 0
+	err := retryListCall(context.Background(), log.WithField("test", "yep"), time.Second, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusNotFound}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusNotFound, err.(*googleapi.Error).Code)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryListCall_budget(t *testing.T) {
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+
+	calls := 0
+	err := retryListCall(context.Background(), log.WithField("test", "yep"), 50*time.Millisecond, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	assert.NotNil(t, err)
+	assert.True(t, calls > 1)
+
+	calls = 0
+	err = retryListCall(context.Background(), log.WithField("test", "yep"), 0, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,172 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/travis-ci/gcloud-cleanup/metrics"
+)
+
+// schedule decides when an entity cleanup runs.
+type schedule interface {
+	// next returns the first run after the given time.
+	next(after time.Time) time.Time
+
+	// immediate reports whether the first run happens right at startup.
+	immediate() bool
+}
+
+// intervalSchedule runs at startup and then every interval.
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) next(after time.Time) time.Time {
+	return after.Add(s.interval)
+}
+
+func (s intervalSchedule) immediate() bool {
+	return true
+}
+
+func (s intervalSchedule) String() string {
+	return s.interval.String()
+}
+
+// cronSchedule runs whenever a cron expression matches.
+type cronSchedule struct {
+	spec     string
+	schedule cron.Schedule
+}
+
+func (s cronSchedule) next(after time.Time) time.Time {
+	return s.schedule.Next(after)
+}
+
+func (s cronSchedule) immediate() bool {
+	return false
+}
+
+func (s cronSchedule) String() string {
+	return s.spec
+}
+
+// parseSchedule parses either a duration such as "15m" or a standard cron
+// expression such as "*/15 * * * *".
+func parseSchedule(spec string) (schedule, error) {
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("schedule interval %q must be positive", spec)
+		}
+		return intervalSchedule{interval: interval}, nil
+	}
+
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q is neither a duration nor a cron expression: %v", spec, err)
+	}
+	return cronSchedule{spec: spec, schedule: s}, nil
+}
+
+// parseEntitySchedules parses entries of the form "<entity>=<schedule>" into
+// a map of entity to schedule.
+func parseEntitySchedules(entries []string) (map[string]schedule, error) {
+	schedules := map[string]schedule{}
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid entity schedule %q", entry)
+		}
+
+		s, err := parseSchedule(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		schedules[strings.TrimSpace(parts[0])] = s
+	}
+
+	return schedules, nil
+}
+
+// entityScheduler runs the cleanup of an entity on its schedule, each run in
+// its own goroutine. A run that is due while the previous one is still going
+// is skipped rather than stacked.
+type entityScheduler struct {
+	entity   string
+	schedule schedule
+	jitter   time.Duration
+	run      func(context.Context)
+
+	log    *logrus.Entry
+	status *runStatus
+
+	running int32
+}
+
+// start runs the scheduler until ctx is done. Runs are added to wg so that
+// they can be waited for on shutdown.
+func (es *entityScheduler) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		now := time.Now()
+		next := now
+		if !es.schedule.immediate() {
+			next = es.schedule.next(now)
+		}
+
+		for {
+			runAt := next.Add(es.jitterDelay())
+
+			es.log.WithFields(logrus.Fields{
+				"schedule": es.schedule,
+				"next_run": runAt.Format(time.RFC3339),
+			}).Info("scheduled next run")
+			es.status.scheduled(es.entity, runAt)
+
+			if sleepContext(ctx, time.Until(runAt)) != nil {
+				return
+			}
+
+			es.trigger(ctx, wg)
+
+			next = es.schedule.next(time.Now())
+		}
+	}()
+}
+
+// trigger starts a run unless the previous one is still going.
+func (es *entityScheduler) trigger(ctx context.Context, wg *sync.WaitGroup) {
+	if !atomic.CompareAndSwapInt32(&es.running, 0, 1) {
+		es.log.Warn("previous run still in progress, skipping run")
+		metrics.Mark(fmt.Sprintf("travis.gcloud-cleanup.%s.skipped_runs", es.entity))
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer atomic.StoreInt32(&es.running, 0)
+
+		es.run(ctx)
+	}()
+}
+
+func (es *entityScheduler) jitterDelay() time.Duration {
+	if es.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(es.jitter)))
+}
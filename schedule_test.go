@@ -0,0 +1,112 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	now := time.Date(2018, 9, 10, 12, 7, 30, 0, time.UTC)
+
+	s, err := parseSchedule("15m")
+	assert.Nil(t, err)
+	assert.True(t, s.immediate())
+	assert.Equal(t, now.Add(15*time.Minute), s.next(now))
+
+	s, err = parseSchedule("*/15 * * * *")
+	assert.Nil(t, err)
+	assert.False(t, s.immediate())
+	assert.Equal(t, time.Date(2018, 9, 10, 12, 15, 0, 0, time.UTC), s.next(now))
+
+	for _, spec := range []string{"", "0s", "-5m", "every hour", "* * *"} {
+		_, err := parseSchedule(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestParseEntitySchedules(t *testing.T) {
+	schedules, err := parseEntitySchedules([]string{"instances=5m", " images = 0 3 * * *"})
+	assert.Nil(t, err)
+	assert.Len(t, schedules, 2)
+	assert.Equal(t, intervalSchedule{interval: 5 * time.Minute}, schedules["instances"])
+	assert.Equal(t, "0 3 * * *", schedules["images"].(cronSchedule).String())
+
+	for _, entry := range []string{"instances", "=5m", "instances=", "instances=soon"} {
+		_, err := parseEntitySchedules([]string{entry})
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestEntityScheduler_trigger(t *testing.T) {
+	release := make(chan struct{})
+	runs := make(chan struct{}, 2)
+
+	es := &entityScheduler{
+		entity: "instances",
+		run: func(ctx context.Context) {
+			runs <- struct{}{}
+			<-release
+		},
+		log: logrus.New().WithField("entity", "instances"),
+	}
+
+	wg := &sync.WaitGroup{}
+	es.trigger(context.Background(), wg)
+	<-runs
+
+	// the previous run is still going, so this one is skipped
+	es.trigger(context.Background(), wg)
+
+	close(release)
+	wg.Wait()
+	assert.Len(t, runs, 0)
+
+	es.trigger(context.Background(), wg)
+	wg.Wait()
+	assert.Len(t, runs, 1)
+}
+
+func TestEntityScheduler_start(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan struct{}, 10)
+
+	es := &entityScheduler{
+		entity:   "instances",
+		schedule: intervalSchedule{interval: time.Hour},
+		run: func(ctx context.Context) {
+			runs <- struct{}{}
+		},
+		log:    logrus.New().WithField("entity", "instances"),
+		status: newRunStatus(time.Minute, time.Now()),
+	}
+
+	wg := &sync.WaitGroup{}
+	es.start(ctx, wg)
+
+	// intervals run right away at startup
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("expected a run at startup")
+	}
+
+	cancel()
+	wg.Wait()
+	assert.Len(t, runs, 0)
+}
+
+func TestEntityScheduler_jitterDelay(t *testing.T) {
+	es := &entityScheduler{}
+	assert.Equal(t, time.Duration(0), es.jitterDelay())
+
+	es.jitter = time.Minute
+	for i := 0; i < 10; i++ {
+		delay := es.jitterDelay()
+		assert.True(t, delay >= 0 && delay < time.Minute)
+	}
+}
@@ -0,0 +1,47 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// withGracePeriod returns a context that is cancelled grace after ctx is
+// done, so that work already in flight when shutting down gets a chance to
+// finish. If the leader lease of ctx is lost, it is cancelled right away
+// instead, as another replica may already be cleaning up. The returned
+// context carries the trace span of ctx.
+func withGracePeriod(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(trace.NewContext(context.Background(), trace.FromContext(ctx)))
+	lost := leaseLost(ctx)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+
+		select {
+		case <-time.After(grace):
+			cancel()
+		case <-lost:
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+
+	return graceCtx, cancel
+}
+
+// sleepContext sleeps for the given duration or until ctx is done, whichever
+// happens first.
+func sleepContext(ctx context.Context, dur time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(dur):
+		return nil
+	}
+}
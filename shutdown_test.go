@@ -0,0 +1,42 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	graceCtx, graceCancel := withGracePeriod(ctx, 50*time.Millisecond)
+	defer graceCancel()
+
+	cancel()
+	assert.Nil(t, graceCtx.Err())
+
+	select {
+	case <-graceCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("grace context was not cancelled after grace period")
+	}
+}
+
+func TestWithGracePeriod_cancel(t *testing.T) {
+	graceCtx, graceCancel := withGracePeriod(context.Background(), time.Hour)
+	graceCancel()
+	assert.Equal(t, context.Canceled, graceCtx.Err())
+}
+
+func TestSleepContext(t *testing.T) {
+	assert.Nil(t, sleepContext(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	assert.Equal(t, context.Canceled, sleepContext(ctx, time.Hour))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,316 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	travismetrics "github.com/travis-ci/gcloud-cleanup/metrics"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+type snapshotCleaner struct {
+	cs  *compute.Service
+	log *logrus.Entry
+
+	projectID string
+	filters   []string
+
+	noop bool
+
+	// KeepLast is the number of most recent snapshots per source disk that
+	// are retained regardless of their age.
+	KeepLast   int
+	CutoffTime time.Time
+
+	// plan collects the snapshots that would be deleted instead of deleting
+	// them
+	plan *plan
+
+	operationTimeout  time.Duration
+	deleteConcurrency int
+
+	// listRetryBudget is how long failing list calls are retried before
+	// giving up on the run
+	listRetryBudget time.Duration
+
+	// shutdownGracePeriod is how long in-flight deletions may keep running
+	// once the context passed to Run is done
+	shutdownGracePeriod time.Duration
+
+	rateLimiter ratelimit.RateLimiter
+	rateLimits  rateLimits
+
+	// lastCounts holds the counts of the last run
+	lastCounts map[string]int64
+}
+
+type snapshotDeletionRequest struct {
+	Snapshot *compute.Snapshot
+	Reason   string
+}
+
+type timestampedSnapshot struct {
+	snapshot *compute.Snapshot
+	created  time.Time
+}
+
+func (sc *snapshotCleaner) Run(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "SnapshotCleanerRun")
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("app", "gcloud-cleanup"),
+	)
+
+	sc.log.WithFields(logrus.Fields{
+		"project":     sc.projectID,
+		"cutoff_time": sc.CutoffTime.Format(time.RFC3339),
+		"keep_last":   sc.KeepLast,
+		"filters":     strings.Join(sc.filters, ","),
+	}).Info("running snapshot cleanup")
+
+	snapChan := make(chan *snapshotDeletionRequest)
+	errChan := make(chan error)
+
+	go sc.fetchSnapshotsToDelete(ctx, snapChan, errChan)
+	fetchErrChan := collectFetchErrors(sc.log, "error during snapshot fetch", errChan)
+
+	nDeleted := int64(0)
+	nFailed := int64(0)
+	nSkipped := int64(0)
+
+	workCtx, cancel := withGracePeriod(ctx, sc.shutdownGracePeriod)
+	defer cancel()
+
+	runWorkers(workCtx, sc.deleteConcurrency, "SnapshotDeleteWorker", func(workCtx context.Context, worker int) {
+		for req := range snapChan {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&nSkipped, 1)
+				continue
+			}
+
+			if sc.plan != nil {
+				sc.plan.add(sc.projectID, "snapshots", req.Snapshot.Name, "",
+					req.Snapshot.CreationTimestamp, req.Reason, "", policyActionDelete,
+					req.Snapshot.Labels, time.Now().UTC())
+				continue
+			}
+
+			err := sc.deleteSnapshot(workCtx, req.Snapshot)
+
+			if err != nil {
+				atomic.AddInt64(&nFailed, 1)
+				travismetrics.ResourceFailed(sc.projectID, "snapshots", "deleted", "")
+
+				sc.log.WithFields(logrus.Fields{
+					"err":      err,
+					"snapshot": req.Snapshot.Name,
+					"worker":   worker,
+				}).Warn("failed to delete snapshot")
+				continue
+			}
+
+			atomic.AddInt64(&nDeleted, 1)
+			travismetrics.ResourceCleaned(sc.projectID, "snapshots", "deleted", req.Reason, "")
+
+			sc.log.WithFields(logrus.Fields{
+				"snapshot": req.Snapshot.Name,
+				"reason":   req.Reason,
+				"worker":   worker,
+			}).Info("deleted")
+		}
+	})
+
+	sc.lastCounts = map[string]int64{
+		"deleted": nDeleted,
+		"failed":  nFailed,
+		"skipped": nSkipped,
+	}
+
+	projectCounter(sc.projectID, "snapshots.deleted", nDeleted)
+	projectCounter(sc.projectID, "snapshots.failed", nFailed)
+	sc.l2met("measure#snapshots.failed", int(nFailed), "counted failed snapshot deletions")
+	sc.l2met("measure#snapshots.deleted", int(nDeleted), "done running snapshot cleanup")
+
+	if nSkipped > 0 {
+		sc.log.WithField("skipped", nSkipped).Warn("skipped snapshots due to shutdown")
+	}
+
+	fetchErr := <-fetchErrChan
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	return ctx.Err()
+}
+
+func (sc *snapshotCleaner) fetchSnapshotsToDelete(ctx context.Context, snapChan chan *snapshotDeletionRequest, errChan chan error) {
+	ctx, span := trace.StartSpan(ctx, "FetchSnapshotsToDelete")
+	defer span.End()
+
+	defer close(errChan)
+	defer close(snapChan)
+
+	listCall := sc.cs.Snapshots.List(sc.projectID)
+	for _, filter := range sc.filters {
+		listCall.Filter(filter)
+	}
+
+	pageTok := ""
+	nSnapshots := 0
+	bySourceDisk := map[string][]*timestampedSnapshot{}
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if pageTok != "" {
+			listCall.PageToken(pageTok)
+		}
+
+		sc.log.WithField("page_token", pageTok).Debug("fetching snapshots list")
+
+		var resp *compute.SnapshotList
+		err := retryListCall(ctx, sc.log, sc.listRetryBudget, func() (err error) {
+			if err = sc.rateLimits.wait(ctx, sc.rateLimiter, rateLimitBucketList); err != nil {
+				return
+			}
+			resp, err = listCall.Context(ctx).Do()
+			return
+		})
+
+		if err != nil {
+			errChan <- errors.Wrap(err, "could not list snapshots")
+			return
+		}
+
+		for _, snap := range resp.Items {
+			nSnapshots++
+
+			// snapshots with an unparsable creation timestamp are never
+			// deleted and don't take up the keep-last slots of their disk
+			ts, err := time.Parse(time.RFC3339, snap.CreationTimestamp)
+
+			if err != nil {
+				sc.log.WithFields(logrus.Fields{
+					"err":      err,
+					"snapshot": snap.Name,
+				}).Warn("failed to parse creation timestamp, keeping snapshot")
+				continue
+			}
+
+			bySourceDisk[snap.SourceDisk] = append(bySourceDisk[snap.SourceDisk],
+				&timestampedSnapshot{snapshot: snap, created: ts.UTC()})
+		}
+
+		if resp.NextPageToken == "" {
+			sc.log.Debug("no next page, breaking out of loop")
+			break
+		}
+
+		sc.log.Debug("continuing to next page")
+		pageTok = resp.NextPageToken
+	}
+
+	for sourceDisk, snaps := range bySourceDisk {
+		sort.Slice(snaps, func(i, j int) bool {
+			return snaps[i].created.After(snaps[j].created)
+		})
+
+		for i, ts := range snaps {
+			log := sc.log.WithFields(logrus.Fields{
+				"snapshot":    ts.snapshot.Name,
+				"source_disk": sourceDisk,
+			})
+
+			if i < sc.KeepLast {
+				log.WithField("position", i).Debug("keeping recent snapshot")
+				continue
+			}
+
+			if ts.created.Before(sc.CutoffTime) {
+				log.WithFields(logrus.Fields{
+					"created": ts.created.Format(time.RFC3339),
+					"cutoff":  sc.CutoffTime.Format(time.RFC3339),
+				}).Debug("sending snapshot for deletion")
+
+				select {
+				case snapChan <- &snapshotDeletionRequest{Snapshot: ts.snapshot, Reason: "expired"}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			log.Debug("skipping snapshot")
+		}
+	}
+
+	sc.l2met("gauge#snapshots.source_disks", len(bySourceDisk), "counted snapshot source disks")
+	sc.l2met("gauge#snapshots.count", nSnapshots, "done checking all snapshots")
+}
+
+// getSnapshot looks up a snapshot by name.
+func (sc *snapshotCleaner) getSnapshot(ctx context.Context, name string) (*compute.Snapshot, error) {
+	var snap *compute.Snapshot
+	err := retryListCall(ctx, sc.log, sc.listRetryBudget, func() (err error) {
+		if err = sc.rateLimits.wait(ctx, sc.rateLimiter, rateLimitBucketList); err != nil {
+			return
+		}
+		snap, err = sc.cs.Snapshots.Get(sc.projectID, name).Context(ctx).Do()
+		return
+	})
+	if isNotFoundError(err) {
+		return nil, errors.Wrapf(errResourceNotFound, "snapshot %s", name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get snapshot")
+	}
+	return snap, nil
+}
+
+func (sc *snapshotCleaner) deleteSnapshot(ctx context.Context, snap *compute.Snapshot) error {
+	ctx, span := trace.StartSpan(ctx, "DeleteSnapshot")
+	defer span.End()
+
+	if sc.noop {
+		sc.log.WithField("snapshot", snap.Name).Debug("not really deleting snapshot")
+		return nil
+	}
+
+	if err := sc.rateLimits.wait(ctx, sc.rateLimiter, rateLimitBucketDelete); err != nil {
+		return err
+	}
+	op, err := sc.cs.Snapshots.Delete(sc.projectID, snap.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	op, err = waitForOperation(ctx, op, sc.operationTimeout, func(ctx context.Context, name string) (*compute.Operation, error) {
+		if err := sc.rateLimits.wait(ctx, sc.rateLimiter, rateLimitBucketOperations); err != nil {
+			return nil, err
+		}
+		return sc.cs.GlobalOperations.Get(sc.projectID, name).Context(ctx).Do()
+	})
+
+	sc.log.WithFields(logrus.Fields{
+		"snapshot":  snap.Name,
+		"operation": op.Name,
+		"status":    op.Status,
+	}).Debug("finished waiting for delete operation")
+
+	return err
+}
+
+func (sc *snapshotCleaner) l2met(name string, n int, msg string) {
+	sc.log.WithField(name, n).Info(msg)
+}
@@ -0,0 +1,118 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/gcloud-cleanup/ratelimit"
+)
+
+func TestSnapshotCleaner_Run(t *testing.T) {
+	var mu sync.Mutex
+	deleted := map[string]bool{}
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		"/foo-project/global/snapshots",
+		func(w http.ResponseWriter, req *http.Request) {
+			body := map[string]interface{}{
+				"items": []interface{}{
+					map[string]string{
+						"name":              "test-snap-a-0",
+						"sourceDisk":        "zones/us-central1-a/disks/a",
+						"creationTimestamp": old.Add(-3 * time.Hour).Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-a-1",
+						"sourceDisk":        "zones/us-central1-a/disks/a",
+						"creationTimestamp": old.Add(-2 * time.Hour).Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-a-2",
+						"sourceDisk":        "zones/us-central1-a/disks/a",
+						"creationTimestamp": old.Add(-1 * time.Hour).Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-b-0",
+						"sourceDisk":        "zones/us-central1-a/disks/b",
+						"creationTimestamp": old.Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-c-0",
+						"sourceDisk":        "zones/us-central1-a/disks/c",
+						"creationTimestamp": time.Now().Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-c-1",
+						"sourceDisk":        "zones/us-central1-a/disks/c",
+						"creationTimestamp": time.Now().Add(-1 * time.Minute).Format(time.RFC3339),
+					},
+					map[string]string{
+						"name":              "test-snap-d-0",
+						"sourceDisk":        "zones/us-central1-a/disks/d",
+						"creationTimestamp": "yesterday",
+					},
+					map[string]string{
+						"name":              "test-snap-d-1",
+						"sourceDisk":        "zones/us-central1-a/disks/d",
+						"creationTimestamp": old.Format(time.RFC3339),
+					},
+				},
+			}
+			err := json.NewEncoder(w).Encode(body)
+			assert.Nil(t, err)
+		})
+	mux.HandleFunc("/foo-project/global/snapshots/",
+		func(w http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, req.Method, "DELETE")
+			mu.Lock()
+			deleted[req.URL.Path[len("/foo-project/global/snapshots/"):]] = true
+			mu.Unlock()
+			fmt.Fprintf(w, `{"name": "op-0", "status": "DONE"}`)
+		})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cs, err := compute.New(&http.Client{})
+	assert.Nil(t, err)
+	cs.BasePath = srv.URL
+
+	log := logrus.New()
+	log.Level = logrus.FatalLevel
+	if os.Getenv("GCLOUD_CLEANUP_TEST_DEBUG") != "" {
+		log.Level = logrus.DebugLevel
+	}
+
+	sc := &snapshotCleaner{
+		cs:                cs,
+		log:               log.WithField("test", "yep"),
+		rateLimiter:       ratelimit.NewNullRateLimiter(),
+		rateLimits:        defaultRateLimits(10, time.Second),
+		deleteConcurrency: 4,
+		KeepLast:          1,
+		CutoffTime:        time.Now().Add(-24 * time.Hour),
+		projectID:         "foo-project",
+		noop:              false,
+	}
+
+	err = sc.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{
+		"test-snap-a-0": true,
+		"test-snap-a-1": true,
+	}, deleted)
+}
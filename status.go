@@ -0,0 +1,239 @@
+package gcloudcleanup
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	outcomeRunning     = "running"
+	outcomeSuccess     = "success"
+	outcomeFailure     = "failure"
+	outcomeInterrupted = "interrupted"
+	outcomeBackingOff  = "backing-off"
+)
+
+// entityRunStatus is the last known state of an entity cleanup in a single
+// project.
+type entityRunStatus struct {
+	Project   string           `json:"project"`
+	Entity    string           `json:"entity"`
+	Outcome   string           `json:"outcome"`
+	Error     string           `json:"error,omitempty"`
+	LastStart *time.Time       `json:"last_start,omitempty"`
+	LastEnd   *time.Time       `json:"last_end,omitempty"`
+	NextRun   *time.Time       `json:"next_run,omitempty"`
+	Counts    map[string]int64 `json:"counts,omitempty"`
+}
+
+// runStatus tracks the progress of the entity cleanups and serves it on the
+// /healthz, /readyz and /status endpoints. An entity cleanup is considered
+// stuck once it has made no progress for stallTimeout beyond its next
+// scheduled run.
+type runStatus struct {
+	sync.Mutex
+
+	stallTimeout time.Duration
+
+	startedAt time.Time
+	ready     bool
+	leader    string
+
+	// deadline applies until the first entity is scheduled, after which each
+	// entity has its own deadline
+	deadline  time.Time
+	deadlines map[string]time.Time
+
+	entities map[string]*entityRunStatus
+}
+
+func newRunStatus(stallTimeout time.Duration, now time.Time) *runStatus {
+	return &runStatus{
+		stallTimeout: stallTimeout,
+		startedAt:    now,
+		deadline:     now.Add(stallTimeout),
+		deadlines:    map[string]time.Time{},
+		entities:     map[string]*entityRunStatus{},
+	}
+}
+
+func (rs *runStatus) entity(entity, projectID string) *entityRunStatus {
+	key := projectID + "/" + entity
+
+	ers, ok := rs.entities[key]
+	if !ok {
+		ers = &entityRunStatus{Project: projectID, Entity: entity}
+		rs.entities[key] = ers
+	}
+	return ers
+}
+
+// setReady marks whether the cleanup loop is set up and not shutting down.
+func (rs *runStatus) setReady(ready bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.ready = ready
+}
+
+// started records the start of an entity cleanup.
+func (rs *runStatus) started(entity, projectID string, now time.Time) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	ers := rs.entity(entity, projectID)
+	ers.Outcome = outcomeRunning
+	ers.LastStart = &now
+	if ers.NextRun != nil && !ers.NextRun.After(now) {
+		ers.NextRun = nil
+	}
+	rs.deadlines[entity] = now.Add(rs.stallTimeout)
+}
+
+// finished records the outcome and counts of an entity cleanup.
+func (rs *runStatus) finished(entity, projectID string, now time.Time, outcome string, err error, counts map[string]int64) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	ers := rs.entity(entity, projectID)
+	ers.Outcome = outcome
+	ers.LastEnd = &now
+	ers.Counts = counts
+	ers.Error = ""
+	if err != nil {
+		ers.Error = err.Error()
+	}
+	rs.deadlines[entity] = now.Add(rs.stallTimeout)
+}
+
+// backingOff records that an entity cleanup was skipped until retryAt.
+func (rs *runStatus) backingOff(entity, projectID string, now, retryAt time.Time) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	ers := rs.entity(entity, projectID)
+	ers.Outcome = outcomeBackingOff
+	ers.NextRun = &retryAt
+	rs.deadlines[entity] = now.Add(rs.stallTimeout)
+}
+
+// scheduled records that the entity runs next at the given time in every
+// project it isn't backing off in any longer. A run still in progress keeps
+// its deadline, so that it is noticed if it gets stuck.
+func (rs *runStatus) scheduled(entity string, next time.Time) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	running := false
+	for _, ers := range rs.entities {
+		if ers.Entity != entity {
+			continue
+		}
+		if ers.Outcome == outcomeRunning {
+			running = true
+		}
+		if ers.NextRun == nil || ers.NextRun.Before(next) {
+			ers.NextRun = &next
+		}
+	}
+
+	if _, ok := rs.deadlines[entity]; !ok || !running {
+		rs.deadlines[entity] = next.Add(rs.stallTimeout)
+	}
+}
+
+// setLeader records the id of the replica currently leading, if leader
+// election is enabled.
+func (rs *runStatus) setLeader(leader string) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.leader = leader
+}
+
+func (rs *runStatus) healthy(now time.Time) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.healthyLocked(now)
+}
+
+func (rs *runStatus) healthyLocked(now time.Time) bool {
+	if len(rs.deadlines) == 0 {
+		return now.Before(rs.deadline)
+	}
+
+	for _, deadline := range rs.deadlines {
+		if !now.Before(deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs *runStatus) isReady() bool {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.ready
+}
+
+// snapshot returns the status document served on /status.
+func (rs *runStatus) snapshot(now time.Time) map[string]interface{} {
+	rs.Lock()
+	defer rs.Unlock()
+
+	entities := []entityRunStatus{}
+	for _, ers := range rs.entities {
+		entities = append(entities, *ers)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Project != entities[j].Project {
+			return entities[i].Project < entities[j].Project
+		}
+		return entities[i].Entity < entities[j].Entity
+	})
+
+	snapshot := map[string]interface{}{
+		"version":    VersionString,
+		"started_at": rs.startedAt,
+		"uptime":     now.Sub(rs.startedAt).Truncate(time.Second).String(),
+		"healthy":    rs.healthyLocked(now),
+		"ready":      rs.ready,
+		"entities":   entities,
+	}
+	if rs.leader != "" {
+		snapshot["leader"] = rs.leader
+	}
+
+	return snapshot
+}
+
+func (rs *runStatus) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if !rs.healthy(time.Now()) {
+			http.Error(w, "entity cleanup stalled", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if !rs.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(rs.snapshot(time.Now()))
+	})
+
+	return mux
+}
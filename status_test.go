@@ -0,0 +1,98 @@
+package gcloudcleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunStatus_healthy(t *testing.T) {
+	now := time.Now()
+	rs := newRunStatus(10*time.Minute, now)
+
+	assert.True(t, rs.healthy(now))
+	assert.False(t, rs.healthy(now.Add(11*time.Minute)))
+
+	rs.started("instances", "foo", now.Add(5*time.Minute))
+	assert.True(t, rs.healthy(now.Add(11*time.Minute)))
+	assert.False(t, rs.healthy(now.Add(16*time.Minute)))
+
+	rs.finished("instances", "foo", now.Add(6*time.Minute), outcomeSuccess, nil, nil)
+	rs.scheduled("instances", now.Add(time.Hour))
+	assert.True(t, rs.healthy(now.Add(65*time.Minute)))
+	assert.False(t, rs.healthy(now.Add(71*time.Minute)))
+}
+
+func TestRunStatus_healthy_perEntity(t *testing.T) {
+	now := time.Now()
+	rs := newRunStatus(10*time.Minute, now)
+
+	rs.scheduled("instances", now.Add(time.Hour))
+	rs.scheduled("images", now.Add(5*time.Minute))
+	assert.True(t, rs.healthy(now.Add(11*time.Minute)))
+
+	rs.started("images", "foo", now.Add(5*time.Minute))
+	assert.True(t, rs.healthy(now.Add(14*time.Minute)))
+
+	// a run in progress isn't given more time by its next schedule
+	rs.scheduled("images", now.Add(10*time.Minute))
+	assert.False(t, rs.healthy(now.Add(16*time.Minute)))
+
+	rs.finished("images", "foo", now.Add(12*time.Minute), outcomeSuccess, nil, nil)
+	rs.scheduled("images", now.Add(30*time.Minute))
+	assert.True(t, rs.healthy(now.Add(35*time.Minute)))
+	assert.False(t, rs.healthy(now.Add(41*time.Minute)))
+}
+
+func TestRunStatus_handler(t *testing.T) {
+	now := time.Now()
+	rs := newRunStatus(10*time.Minute, now)
+	h := rs.handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	rs.setReady(true)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	rs.started("instances", "foo", now)
+	rs.finished("instances", "foo", now.Add(time.Minute), outcomeSuccess, nil, map[string]int64{"deleted": 3})
+	rs.started("images", "foo", now.Add(time.Minute))
+	rs.finished("images", "foo", now.Add(2*time.Minute), outcomeFailure, errors.New("no job-board"), nil)
+	rs.scheduled("instances", now.Add(7*time.Minute))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	doc := struct {
+		Ready    bool              `json:"ready"`
+		Entities []entityRunStatus `json:"entities"`
+	}{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&doc))
+	assert.True(t, doc.Ready)
+	assert.Len(t, doc.Entities, 2)
+
+	assert.Equal(t, "images", doc.Entities[0].Entity)
+	assert.Equal(t, outcomeFailure, doc.Entities[0].Outcome)
+	assert.Equal(t, "no job-board", doc.Entities[0].Error)
+
+	assert.Equal(t, "instances", doc.Entities[1].Entity)
+	assert.Equal(t, outcomeSuccess, doc.Entities[1].Outcome)
+	assert.Equal(t, int64(3), doc.Entities[1].Counts["deleted"])
+	assert.True(t, now.Add(7*time.Minute).Equal(*doc.Entities[1].NextRun))
+}
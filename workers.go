@@ -0,0 +1,37 @@
+package gcloudcleanup
+
+import (
+	"context"
+	"sync"
+
+	"go.opencensus.io/trace"
+)
+
+// runWorkers starts n goroutines running f, each within its own trace span,
+// and blocks until all of them have returned.
+func runWorkers(ctx context.Context, n int, spanName string, f func(ctx context.Context, worker int)) {
+	if n < 1 {
+		n = 1
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			ctx, span := trace.StartSpan(ctx, spanName)
+			defer span.End()
+
+			span.AddAttributes(
+				trace.Int64Attribute("worker", int64(worker)),
+			)
+
+			f(ctx, worker)
+		}(i)
+	}
+
+	wg.Wait()
+}